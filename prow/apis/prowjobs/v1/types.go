@@ -487,6 +487,12 @@ func (d *DecorationConfig) Validate() error {
 	if d.OauthTokenSecret != nil && len(d.SSHKeySecrets) > 0 {
 		return errors.New("both OAuth token and SSH key secrets are specified")
 	}
+	if d.Timeout.Get() < 0 {
+		return fmt.Errorf("timeout %v must not be negative", d.Timeout.Get())
+	}
+	if d.GracePeriod.Get() < 0 {
+		return fmt.Errorf("grace period %v must not be negative", d.GracePeriod.Get())
+	}
 	return nil
 }
 
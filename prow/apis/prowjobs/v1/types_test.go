@@ -196,6 +196,60 @@ func TestDecorationDefaulting(t *testing.T) {
 	}
 }
 
+func TestDecorationConfigValidate(t *testing.T) {
+	validConfig := func() *DecorationConfig {
+		return &DecorationConfig{
+			UtilityImages: &UtilityImages{
+				CloneRefs:  "clonerefs:default",
+				InitUpload: "initupload:default",
+				Entrypoint: "entrypoint:default",
+				Sidecar:    "sidecar:default",
+			},
+			GCSConfiguration: &GCSConfiguration{
+				Bucket:       "default-bucket",
+				PathStrategy: PathStrategyExplicit,
+			},
+			GCSCredentialsSecret: "default-service-account",
+		}
+	}
+
+	var testCases = []struct {
+		name        string
+		modify      func(*DecorationConfig)
+		errExpected bool
+	}{
+		{
+			name:   "valid config",
+			modify: func(*DecorationConfig) {},
+		},
+		{
+			name:        "missing utility images",
+			modify:      func(d *DecorationConfig) { d.UtilityImages = nil },
+			errExpected: true,
+		},
+		{
+			name:        "negative timeout",
+			modify:      func(d *DecorationConfig) { d.Timeout = &Duration{Duration: -time.Minute} },
+			errExpected: true,
+		},
+		{
+			name:        "negative grace period",
+			modify:      func(d *DecorationConfig) { d.GracePeriod = &Duration{Duration: -time.Minute} },
+			errExpected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := validConfig()
+			tc.modify(config)
+			if err := config.Validate(); (err != nil) != tc.errExpected {
+				t.Errorf("Expected error %v, got %v", tc.errExpected, err)
+			}
+		})
+	}
+}
+
 func TestRefsToString(t *testing.T) {
 	var tests = []struct {
 		name     string
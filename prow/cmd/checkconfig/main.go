@@ -1002,8 +1002,8 @@ func validateInRepoConfig(cfg *config.Config, filePath, repoIdentifier string) e
 		return nil
 	}
 
-	prowYAML := &config.ProwYAML{}
-	if err := yaml.Unmarshal(data, prowYAML); err != nil {
+	prowYAML, err := config.ReadProwYAMLFromBytes(logrus.WithField("file", filePath), data, false)
+	if err != nil {
 		return fmt.Errorf("failed to deserialize content of %q: %v", filePath, err)
 	}
 
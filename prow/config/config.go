@@ -20,6 +20,8 @@ package config
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -59,6 +61,30 @@ const (
 	// DefaultJobTimeout represents the default deadline for a prow job.
 	DefaultJobTimeout = 24 * time.Hour
 
+	// DefaultInRepoConfigMaxFileSize is the default maximum size in bytes of
+	// an in-repo config file.
+	DefaultInRepoConfigMaxFileSize = 5 * 1024 * 1024
+
+	// DefaultInRepoConfigCloneTimeout is the default time after which getting
+	// a clone of a repository to read its in-repo config is aborted.
+	DefaultInRepoConfigCloneTimeout = 10 * time.Minute
+
+	// DefaultInRepoConfigCloneAttempts is the default number of times getting
+	// a clone of a repository to read its in-repo config is attempted.
+	DefaultInRepoConfigCloneAttempts = 3
+
+	// DefaultInRepoConfigCloneRetryDelay is the default time to wait before
+	// the first retry of a failed clone. It doubles with every retry.
+	DefaultInRepoConfigCloneRetryDelay = time.Second
+
+	// DefaultInRepoConfigGitUserName is the default user.name that is set in
+	// clones used to read the in-repo config.
+	DefaultInRepoConfigGitUserName = "prow"
+
+	// DefaultInRepoConfigGitUserEmail is the default user.email that is set in
+	// clones used to read the in-repo config.
+	DefaultInRepoConfigGitUserEmail = "prow@localhost"
+
 	ProwImplicitGitResource = "PROW_IMPLICIT_GIT_REF"
 )
 
@@ -172,43 +198,329 @@ type InRepoConfig struct {
 	// a given repo. All clusters that are allowed for the specific repo, its org or
 	// globally can be used.
 	AllowedClusters map[string][]string `json:"allowed_clusters,omitempty"`
+	// AllowedAgents is a list of agents that jobs of a given repo may use. All agents
+	// that are allowed for the specific repo, its org or globally can be used. If it
+	// is empty, all agents are allowed.
+	AllowedAgents map[string][]string `json:"allowed_agents,omitempty"`
+	// MaxFileSize is the maximum size in bytes of an in-repo config file. Bigger
+	// files are rejected without being read. Defaults to 5MiB.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// AllowSymlinks makes Prow read an in-repo config file that is a symlink, as long
+	// as it points to a file inside the repository. By default, such files are ignored.
+	AllowSymlinks bool `json:"allow_symlinks,omitempty"`
+	// AllowedEnvVars lists environment variables of the Prow component that may be
+	// referenced as ${NAME} in string values of the templates, jobs and decoration
+	// config of in-repo config files. References to other variables are left as they are. Referencing an allowed variable that is
+	// not set is an error. If empty, no expansion is done.
+	AllowedEnvVars []string `json:"allowed_env_vars,omitempty"`
+	// CloneTimeout is the time after which getting a clone of a repository to read
+	// its in-repo config is aborted. Defaults to 10 minutes.
+	CloneTimeout *metav1.Duration `json:"clone_timeout,omitempty"`
+	// CloneAttempts is the number of times getting a clone of a repository is
+	// attempted before giving up. Errors that indicate that the repository
+	// doesn't exist and timeouts are not retried. Defaults to 3.
+	CloneAttempts int `json:"clone_attempts,omitempty"`
+	// CloneRetryDelay is the time to wait before the first retry of a failed
+	// clone. It doubles with every retry. Defaults to 1 second.
+	CloneRetryDelay *metav1.Duration `json:"clone_retry_delay,omitempty"`
+	// CloneDepths configures the number of commits of the history of the base and
+	// head SHAs that are fetched to read the in-repo config of a repository,
+	// instead of cloning all of it. The history is deepened as needed to merge the
+	// head SHAs. This can be set globally, per org or per repo using '*', 'org' or
+	// 'org/repo' as key. The narrowest match always takes precedence. Zero or no
+	// match means that the complete history is cloned, which is also done when
+	// the in-repo config at a ref rather than a SHA is read.
+	CloneDepths map[string]int `json:"clone_depths,omitempty"`
+	// MergeRetryMethods configures the merge methods that are tried in order
+	// if the head SHAs can not be merged into the base SHA with the merge
+	// method of Tide, e.g. because of a conflict. Only "merge" and "squash"
+	// are supported. This can be set globally, per org or per repo using '*',
+	// 'org' or 'org/repo' as key. The narrowest match always takes precedence.
+	// No match means that merging is not retried.
+	MergeRetryMethods map[string][]github.PullRequestMergeType `json:"merge_retry_methods,omitempty"`
+	// AllowedBranches configures the branches whose in-repo config is read. If
+	// the base SHA is not in the history of one of them, the in-repo config
+	// is ignored, just as if the repository had none. This can be set
+	// globally, per org or per repo using '*', 'org' or 'org/repo' as key. The
+	// narrowest match always takes precedence. No match or an empty list means
+	// that all branches are allowed. Repositories with allowed branches are
+	// always cloned completely, regardless of CloneDepths.
+	AllowedBranches map[string][]string `json:"allowed_branches,omitempty"`
+	// GitUserName is the user.name that is set in the clone before the head
+	// SHAs are merged into it. Defaults to "prow".
+	GitUserName string `json:"git_user_name,omitempty"`
+	// GitUserEmail is the user.email that is set in the clone before the head
+	// SHAs are merged into it. Defaults to "prow@localhost".
+	GitUserEmail string `json:"git_user_email,omitempty"`
+	// GitCommitGPGSign is the value of commit.gpgsign that is set in the clone
+	// before the head SHAs are merged into it. Defaults to false.
+	GitCommitGPGSign bool `json:"git_commit_gpgsign,omitempty"`
+	// BasePaths configures the directory relative to the repository root in which
+	// the in-repo config file is looked up. This can be set globally, per org or per
+	// repo using '*', 'org' or 'org/repo' as key. The narrowest match always takes
+	// precedence. Defaults to the repository root.
+	BasePaths map[string]string `json:"base_paths,omitempty"`
+	// FileNames configures the name of the in-repo config file without its extension.
+	// The file with the ".yaml" extension is read, or if it doesn't exist, the one
+	// with the ".json" extension. This can be set globally, per org or per repo using
+	// '*', 'org' or 'org/repo' as key. The narrowest match always takes precedence.
+	// Defaults to ".prow".
+	FileNames map[string]string `json:"file_names,omitempty"`
+	// MaxJobs is the maximum number of presubmits and postsubmits a repository may
+	// define in its in-repo config. This can be set globally, per org or per repo
+	// using '*', 'org' or 'org/repo' as key. The narrowest match always takes
+	// precedence. Zero or no match means there is no limit.
+	MaxJobs map[string]int `json:"max_jobs,omitempty"`
+	// Strict makes reading the in-repo config of a repository reject files with
+	// unknown fields. This can be set globally, per org or per repo using '*',
+	// 'org' or 'org/repo' as key. The narrowest match always takes precedence.
+	// Defaults to false.
+	Strict map[string]bool `json:"strict,omitempty"`
+	// RejectEmptyFiles makes reading the in-repo config of a repository reject
+	// files that exist but only contain whitespace or comments, which usually is
+	// a mistake. Otherwise, a warning is logged for them. This can be set
+	// globally, per org or per repo using '*', 'org' or 'org/repo' as key. The
+	// narrowest match always takes precedence. Defaults to false.
+	RejectEmptyFiles map[string]bool `json:"reject_empty_files,omitempty"`
+	// PodSecurityPolicies restrict the security-sensitive settings the pod specs of
+	// in-repo config jobs may use. This can be set globally, per org or per repo using
+	// '*', 'org' or 'org/repo' as key. The narrowest match always takes precedence. If
+	// no policy matches, all settings are allowed.
+	PodSecurityPolicies map[string]InRepoConfigPodSecurityPolicy `json:"pod_security_policies,omitempty"`
+	// SigningKeys are base64-encoded ed25519 public keys. If a key is configured for a
+	// repository, every in-repo config file that is read must have a detached signature
+	// next to it, in a file with the same name plus a ".sig" suffix that contains the
+	// base64-encoded ed25519 signature of the file content. Files with a missing or
+	// invalid signature are rejected. This can be set globally, per org or per repo using
+	// '*', 'org' or 'org/repo' as key. The narrowest match always takes precedence, an
+	// empty key disables the verification.
+	SigningKeys map[string]string `json:"signing_keys,omitempty"`
+	// CacheSize is the number of read in-repo config files that are kept in memory
+	// by the SHA of the git tree they were read from, so identical trees don't
+	// need to be parsed again. Defaulting and validation always happen. Zero, the
+	// default, disables the cache.
+	CacheSize int `json:"cache_size,omitempty"`
+	// NegativeCacheTTL is the time for which it is remembered that a repository has no
+	// in-repo config file at a given base SHA and head SHAs, so it doesn't need to be
+	// cloned again to find that out. Zero, the default, disables the negative cache.
+	NegativeCacheTTL *metav1.Duration `json:"negative_cache_ttl,omitempty"`
+	// Base holds templates and jobs that are added to the in-repo config of every
+	// repository, e.g. to enforce org-wide presubmits. Templates and jobs of a
+	// repository override those of Base that have the same name. Base jobs are
+	// defaulted and validated together with the jobs of the repository.
+	Base *ProwYAML `json:"base,omitempty"`
+	// Transform is called with every read in-repo config before it is defaulted
+	// and validated, so its result is validated like any other in-repo config.
+	// It can't be set in the config file, but must be set in code after the
+	// config was loaded.
+	Transform ProwYAMLTransform `json:"-"`
+}
+
+// InRepoConfigPodSecurityPolicy restricts the security-sensitive settings of the
+// pod specs of in-repo config jobs. Everything it doesn't explicitly allow is
+// rejected.
+type InRepoConfigPodSecurityPolicy struct {
+	// AllowHostNetwork allows pods to use the network namespace of the host.
+	AllowHostNetwork bool `json:"allow_host_network,omitempty"`
+	// AllowHostPID allows pods to use the PID namespace of the host.
+	AllowHostPID bool `json:"allow_host_pid,omitempty"`
+	// AllowHostPathVolumes allows pods to mount directories of the host.
+	AllowHostPathVolumes bool `json:"allow_host_path_volumes,omitempty"`
+	// AllowPrivileged allows containers to run in privileged mode.
+	AllowPrivileged bool `json:"allow_privileged,omitempty"`
+}
+
+// inRepoConfigKeys returns the keys the in-repo config settings of a given
+// repository are looked up with, from the narrowest to the widest: the
+// repository itself, its org and '*'.
+func inRepoConfigKeys(identifier string) []string {
+	keys := []string{identifier}
+	if identifierSlashSplit := strings.Split(identifier, "/"); len(identifierSlashSplit) == 2 {
+		keys = append(keys, identifierSlashSplit[0])
+	}
+	return append(keys, "*")
 }
 
 // InRepoConfigEnabled returns whether InRepoConfig is enabled for a given repository.
 func (c *Config) InRepoConfigEnabled(identifier string) bool {
-	if c.InRepoConfig.Enabled[identifier] != nil {
-		return *c.InRepoConfig.Enabled[identifier]
+	for _, key := range inRepoConfigKeys(identifier) {
+		if c.InRepoConfig.Enabled[key] != nil {
+			return *c.InRepoConfig.Enabled[key]
+		}
+	}
+	return false
+}
+
+// InRepoConfigBasePath returns the directory relative to the repository root in
+// which the in-repo config file of a given repository is looked up.
+func (c *Config) InRepoConfigBasePath(identifier string) string {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if basePath, ok := c.InRepoConfig.BasePaths[key]; ok {
+			return basePath
+		}
+	}
+	return ""
+}
+
+// InRepoConfigFileName returns the name without extension of the in-repo config
+// file of a given repository.
+func (c *Config) InRepoConfigFileName(identifier string) string {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if fileName, ok := c.InRepoConfig.FileNames[key]; ok {
+			return fileName
+		}
+	}
+	return DefaultInRepoConfigFileName
+}
+
+// InRepoConfigSigningKey returns the public key the signatures of the in-repo
+// config files of a given repository are verified with. It is nil if they are
+// not verified.
+func (c *Config) InRepoConfigSigningKey(identifier string) ed25519.PublicKey {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if encoded, ok := c.InRepoConfig.SigningKeys[key]; ok {
+			signingKey, err := decodeSigningKey(encoded)
+			if err != nil {
+				return nil
+			}
+			return signingKey
+		}
+	}
+	return nil
+}
+
+func decodeSigningKey(encoded string) (ed25519.PublicKey, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return key, nil
+}
+
+// InRepoConfigMaxJobs returns the maximum number of jobs the in-repo config of
+// a given repository may define. Zero means there is no limit.
+func (c *Config) InRepoConfigMaxJobs(identifier string) int {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if maxJobs, ok := c.InRepoConfig.MaxJobs[key]; ok {
+			return maxJobs
+		}
+	}
+	return 0
+}
+
+// InRepoConfigCloneDepth returns the number of commits of history to fetch to
+// read the in-repo config of a given repository. Zero means all of it.
+func (c *Config) InRepoConfigCloneDepth(identifier string) int {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if depth, ok := c.InRepoConfig.CloneDepths[key]; ok {
+			return depth
+		}
 	}
-	identifierSlashSplit := strings.Split(identifier, "/")
-	if len(identifierSlashSplit) == 2 && c.InRepoConfig.Enabled[identifierSlashSplit[0]] != nil {
-		return *c.InRepoConfig.Enabled[identifierSlashSplit[0]]
+	return 0
+}
+
+// InRepoConfigMergeRetryMethods returns the merge methods that are tried in
+// order if the head SHAs of a given repository can not be merged with the
+// merge method of Tide.
+func (c *Config) InRepoConfigMergeRetryMethods(identifier string) []github.PullRequestMergeType {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if methods, ok := c.InRepoConfig.MergeRetryMethods[key]; ok {
+			return methods
+		}
 	}
-	if c.InRepoConfig.Enabled["*"] != nil {
-		return *c.InRepoConfig.Enabled["*"]
+	return nil
+}
+
+// InRepoConfigAllowedBranches returns the branches whose in-repo config is
+// read for a given repository. Empty means all branches.
+func (c *Config) InRepoConfigAllowedBranches(identifier string) []string {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if branches, ok := c.InRepoConfig.AllowedBranches[key]; ok {
+			return branches
+		}
+	}
+	return nil
+}
+
+// InRepoConfigPodSecurityPolicy returns the policy for the pod specs of the
+// in-repo config jobs of a given repository. It is nil if no policy applies.
+func (c *Config) InRepoConfigPodSecurityPolicy(identifier string) *InRepoConfigPodSecurityPolicy {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if policy, ok := c.InRepoConfig.PodSecurityPolicies[key]; ok {
+			return &policy
+		}
+	}
+	return nil
+}
+
+// InRepoConfigStrict returns whether in-repo config files with unknown fields
+// are rejected for a given repository.
+func (c *Config) InRepoConfigStrict(identifier string) bool {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if strict, ok := c.InRepoConfig.Strict[key]; ok {
+			return strict
+		}
+	}
+	return false
+}
+
+// InRepoConfigRejectEmptyFiles returns whether in-repo config files that only
+// contain whitespace or comments are rejected for a given repository.
+func (c *Config) InRepoConfigRejectEmptyFiles(identifier string) bool {
+	for _, key := range inRepoConfigKeys(identifier) {
+		if reject, ok := c.InRepoConfig.RejectEmptyFiles[key]; ok {
+			return reject
+		}
 	}
 	return false
 }
 
 // InRepoConfigAllowsCluster determines if a given cluster may be used for a given repository
 func (c *Config) InRepoConfigAllowsCluster(clusterName, repoIdentifier string) bool {
-	for _, allowedCluster := range c.InRepoConfig.AllowedClusters[repoIdentifier] {
-		if allowedCluster == clusterName {
-			return true
+	for _, key := range inRepoConfigKeys(repoIdentifier) {
+		for _, allowedCluster := range c.InRepoConfig.AllowedClusters[key] {
+			if allowedCluster == clusterName {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	identifierSlashSplit := strings.Split(repoIdentifier, "/")
-	if len(identifierSlashSplit) == 2 {
-		for _, allowedCluster := range c.InRepoConfig.AllowedClusters[identifierSlashSplit[0]] {
-			if allowedCluster == clusterName {
+// InRepoConfigAllowsAgent determines if a given agent may be used for a given repository
+func (c *Config) InRepoConfigAllowsAgent(agent, repoIdentifier string) bool {
+	if len(c.InRepoConfig.AllowedAgents) == 0 {
+		return true
+	}
+	for _, key := range inRepoConfigKeys(repoIdentifier) {
+		for _, allowedAgent := range c.InRepoConfig.AllowedAgents[key] {
+			if allowedAgent == agent {
 				return true
 			}
 		}
 	}
+	return false
+}
 
-	for _, allowedCluster := range c.InRepoConfig.AllowedClusters["*"] {
-		if allowedCluster == clusterName {
-			return true
+// inRepoConfigKnowsCluster determines if a given cluster is the default cluster
+// or allowed for at least one repository, org or globally. Prow has no other way
+// of knowing which build clusters exist, so any other cluster is considered to
+// not be defined.
+func (c *Config) inRepoConfigKnowsCluster(clusterName string) bool {
+	if clusterName == kube.DefaultClusterAlias {
+		return true
+	}
+	for _, allowedClusters := range c.InRepoConfig.AllowedClusters {
+		for _, allowedCluster := range allowedClusters {
+			if allowedCluster == clusterName {
+				return true
+			}
 		}
 	}
 	return false
@@ -957,6 +1269,79 @@ func loadConfig(prowConfig, jobConfig string) (*Config, error) {
 		nc.InRepoConfig.AllowedClusters["*"] = []string{kube.DefaultClusterAlias}
 	}
 
+	if nc.InRepoConfig.MaxFileSize == 0 {
+		nc.InRepoConfig.MaxFileSize = DefaultInRepoConfigMaxFileSize
+	}
+
+	if nc.InRepoConfig.CloneTimeout == nil {
+		nc.InRepoConfig.CloneTimeout = &metav1.Duration{Duration: DefaultInRepoConfigCloneTimeout}
+	}
+
+	if nc.InRepoConfig.CloneAttempts == 0 {
+		nc.InRepoConfig.CloneAttempts = DefaultInRepoConfigCloneAttempts
+	}
+
+	if nc.InRepoConfig.CloneRetryDelay == nil {
+		nc.InRepoConfig.CloneRetryDelay = &metav1.Duration{Duration: DefaultInRepoConfigCloneRetryDelay}
+	}
+
+	if nc.InRepoConfig.GitUserName == "" {
+		nc.InRepoConfig.GitUserName = DefaultInRepoConfigGitUserName
+	}
+
+	if nc.InRepoConfig.GitUserEmail == "" {
+		nc.InRepoConfig.GitUserEmail = DefaultInRepoConfigGitUserEmail
+	}
+
+	for identifier, basePath := range nc.InRepoConfig.BasePaths {
+		if filepath.IsAbs(basePath) {
+			return nil, fmt.Errorf("in_repo_config.base_paths[%q]: %q must be a relative path", identifier, basePath)
+		}
+		if cleaned := filepath.Clean(basePath); cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("in_repo_config.base_paths[%q]: %q must not point outside of the repository", identifier, basePath)
+		}
+	}
+
+	for identifier, fileName := range nc.InRepoConfig.FileNames {
+		if fileName == "" || fileName == "." || fileName == ".." || strings.ContainsAny(fileName, `/\`) {
+			return nil, fmt.Errorf("in_repo_config.file_names[%q]: %q must be the name of a file in the base path", identifier, fileName)
+		}
+	}
+
+	for identifier, depth := range nc.InRepoConfig.CloneDepths {
+		if depth < 0 {
+			return nil, fmt.Errorf("in_repo_config.clone_depths[%q]: %d must be a non-negative number", identifier, depth)
+		}
+	}
+
+	for identifier, branches := range nc.InRepoConfig.AllowedBranches {
+		for _, branch := range branches {
+			if branch == "" {
+				return nil, fmt.Errorf("in_repo_config.allowed_branches[%q]: branch names must not be empty", identifier)
+			}
+		}
+	}
+
+	for identifier, methods := range nc.InRepoConfig.MergeRetryMethods {
+		for _, method := range methods {
+			if method != github.MergeMerge && method != github.MergeSquash {
+				return nil, fmt.Errorf("in_repo_config.merge_retry_methods[%q]: merge method %q is not supported, only %q and %q are", identifier, method, github.MergeMerge, github.MergeSquash)
+			}
+		}
+	}
+
+	for identifier, maxJobs := range nc.InRepoConfig.MaxJobs {
+		if maxJobs < 0 {
+			return nil, fmt.Errorf("in_repo_config.max_jobs[%q]: %d must be a non-negative number", identifier, maxJobs)
+		}
+	}
+
+	for identifier, signingKey := range nc.InRepoConfig.SigningKeys {
+		if _, err := decodeSigningKey(signingKey); err != nil {
+			return nil, fmt.Errorf("in_repo_config.signing_keys[%q]: not a valid base64-encoded ed25519 public key: %v", identifier, err)
+		}
+	}
+
 	// TODO(krzyzacy): temporary allow empty jobconfig
 	//                 also temporary allow job config in prow config
 	if jobConfig == "" {
@@ -1315,6 +1700,9 @@ func validateJobBase(v JobBase, jobType prowapi.ProwJobType, podNamespace string
 	if err := validateLabels(v.Labels); err != nil {
 		return err
 	}
+	if err := validateReporterConfig(v.ReporterConfig); err != nil {
+		return fmt.Errorf("reporter_config: %v", err)
+	}
 	if v.Spec == nil || len(v.Spec.Containers) == 0 {
 		return nil // jenkins jobs have no spec
 	}
@@ -2023,6 +2411,31 @@ func validateReporting(j JobBase, r Reporter) error {
 	return nil
 }
 
+// validateReporterConfig validates the reporter config of a job. Unset fields
+// are taken from the config of the reporter, so they are valid.
+func validateReporterConfig(rc *prowapi.ReporterConfig) error {
+	if rc == nil || rc.Slack == nil {
+		return nil
+	}
+	for _, state := range rc.Slack.JobStatesToReport {
+		switch state {
+		case prowapi.TriggeredState, prowapi.PendingState, prowapi.SuccessState, prowapi.FailureState, prowapi.AbortedState, prowapi.ErrorState:
+		default:
+			return fmt.Errorf("slack.job_states_to_report: %q is not a valid job state", state)
+		}
+	}
+	if rc.Slack.ReportTemplate != "" {
+		tmpl, err := template.New("").Parse(rc.Slack.ReportTemplate)
+		if err != nil {
+			return fmt.Errorf("slack.report_template: failed to parse template: %v", err)
+		}
+		if err := tmpl.Execute(&bytes.Buffer{}, &prowapi.ProwJob{}); err != nil {
+			return fmt.Errorf("slack.report_template: failed to execute template: %v", err)
+		}
+	}
+	return nil
+}
+
 // ValidateController validates the provided controller config.
 func ValidateController(c *Controller) error {
 	urlTmpl, err := template.New("JobURL").Parse(c.JobURLTemplateString)
@@ -17,6 +17,9 @@ limitations under the License.
 package config
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -2227,6 +2230,260 @@ in_repo_config:
 				return nil
 			},
 		},
+		{
+			name: "InRepoConfigMaxFileSize gets defaulted if unset",
+			verify: func(c *Config) error {
+				if c.InRepoConfig.MaxFileSize != DefaultInRepoConfigMaxFileSize {
+					return fmt.Errorf("expected c.InRepoConfig.MaxFileSize to be %d, was %d", DefaultInRepoConfigMaxFileSize, c.InRepoConfig.MaxFileSize)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigMaxFileSize doesn't get overwritten",
+			prowConfig: `
+in_repo_config:
+  max_file_size: 1024
+`,
+			verify: func(c *Config) error {
+				if c.InRepoConfig.MaxFileSize != 1024 {
+					return fmt.Errorf("expected c.InRepoConfig.MaxFileSize to be 1024, was %d", c.InRepoConfig.MaxFileSize)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigCloneTimeout gets defaulted if unset",
+			verify: func(c *Config) error {
+				if c.InRepoConfig.CloneTimeout == nil || c.InRepoConfig.CloneTimeout.Duration != DefaultInRepoConfigCloneTimeout {
+					return fmt.Errorf("expected c.InRepoConfig.CloneTimeout to be %v, was %v", DefaultInRepoConfigCloneTimeout, c.InRepoConfig.CloneTimeout)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigCloneTimeout doesn't get overwritten",
+			prowConfig: `
+in_repo_config:
+  clone_timeout: 1m
+`,
+			verify: func(c *Config) error {
+				if c.InRepoConfig.CloneTimeout == nil || c.InRepoConfig.CloneTimeout.Duration != time.Minute {
+					return fmt.Errorf("expected c.InRepoConfig.CloneTimeout to be 1m, was %v", c.InRepoConfig.CloneTimeout)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigBasePaths with absolute path is rejected",
+			prowConfig: `
+in_repo_config:
+  base_paths:
+    org/repo: /component-a
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigBasePaths pointing outside of the repository is rejected",
+			prowConfig: `
+in_repo_config:
+  base_paths:
+    org/repo: component-a/../..
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigCloneAttempts and CloneRetryDelay get defaulted if unset",
+			verify: func(c *Config) error {
+				if c.InRepoConfig.CloneAttempts != DefaultInRepoConfigCloneAttempts {
+					return fmt.Errorf("expected c.InRepoConfig.CloneAttempts to be %d, was %d", DefaultInRepoConfigCloneAttempts, c.InRepoConfig.CloneAttempts)
+				}
+				if c.InRepoConfig.CloneRetryDelay == nil || c.InRepoConfig.CloneRetryDelay.Duration != DefaultInRepoConfigCloneRetryDelay {
+					return fmt.Errorf("expected c.InRepoConfig.CloneRetryDelay to be %v, was %v", DefaultInRepoConfigCloneRetryDelay, c.InRepoConfig.CloneRetryDelay)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigCloneAttempts and CloneRetryDelay don't get overwritten",
+			prowConfig: `
+in_repo_config:
+  clone_attempts: 1
+  clone_retry_delay: 5s
+`,
+			verify: func(c *Config) error {
+				if c.InRepoConfig.CloneAttempts != 1 {
+					return fmt.Errorf("expected c.InRepoConfig.CloneAttempts to be 1, was %d", c.InRepoConfig.CloneAttempts)
+				}
+				if c.InRepoConfig.CloneRetryDelay == nil || c.InRepoConfig.CloneRetryDelay.Duration != 5*time.Second {
+					return fmt.Errorf("expected c.InRepoConfig.CloneRetryDelay to be 5s, was %v", c.InRepoConfig.CloneRetryDelay)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigGitUserName and GitUserEmail get defaulted if unset",
+			verify: func(c *Config) error {
+				if c.InRepoConfig.GitUserName != DefaultInRepoConfigGitUserName {
+					return fmt.Errorf("expected c.InRepoConfig.GitUserName to be %q, was %q", DefaultInRepoConfigGitUserName, c.InRepoConfig.GitUserName)
+				}
+				if c.InRepoConfig.GitUserEmail != DefaultInRepoConfigGitUserEmail {
+					return fmt.Errorf("expected c.InRepoConfig.GitUserEmail to be %q, was %q", DefaultInRepoConfigGitUserEmail, c.InRepoConfig.GitUserEmail)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigGitUserName and GitUserEmail don't get overwritten",
+			prowConfig: `
+in_repo_config:
+  git_user_name: ci-bot
+  git_user_email: ci-bot@example.com
+`,
+			verify: func(c *Config) error {
+				if c.InRepoConfig.GitUserName != "ci-bot" {
+					return fmt.Errorf("expected c.InRepoConfig.GitUserName to be ci-bot, was %q", c.InRepoConfig.GitUserName)
+				}
+				if c.InRepoConfig.GitUserEmail != "ci-bot@example.com" {
+					return fmt.Errorf("expected c.InRepoConfig.GitUserEmail to be ci-bot@example.com, was %q", c.InRepoConfig.GitUserEmail)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigSigningKeys with invalid key is rejected",
+			prowConfig: `
+in_repo_config:
+  signing_keys:
+    org: c2hvcnQ=
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigCloneDepths with negative number is rejected",
+			prowConfig: `
+in_repo_config:
+  clone_depths:
+    org: -1
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigCloneDepths is loaded",
+			prowConfig: `
+in_repo_config:
+  clone_depths:
+    org: 50
+`,
+			verify: func(c *Config) error {
+				if depth := c.InRepoConfigCloneDepth("org/repo"); depth != 50 {
+					return fmt.Errorf("expected clone depth to be 50, was %d", depth)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigAllowedBranches with empty branch is rejected",
+			prowConfig: `
+in_repo_config:
+  allowed_branches:
+    org: [""]
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigAllowedBranches is loaded",
+			prowConfig: `
+in_repo_config:
+  allowed_branches:
+    org: [master]
+`,
+			verify: func(c *Config) error {
+				if branches := c.InRepoConfigAllowedBranches("org/repo"); !reflect.DeepEqual(branches, []string{"master"}) {
+					return fmt.Errorf("expected allowed branches to be [master], were %v", branches)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigMergeRetryMethods with unsupported method is rejected",
+			prowConfig: `
+in_repo_config:
+  merge_retry_methods:
+    org: [rebase]
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigMergeRetryMethods is loaded",
+			prowConfig: `
+in_repo_config:
+  merge_retry_methods:
+    org: [squash, merge]
+`,
+			verify: func(c *Config) error {
+				expected := []github.PullRequestMergeType{github.MergeSquash, github.MergeMerge}
+				if methods := c.InRepoConfigMergeRetryMethods("org/repo"); !reflect.DeepEqual(methods, expected) {
+					return fmt.Errorf("expected merge retry methods to be %v, were %v", expected, methods)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigMaxJobs with negative number is rejected",
+			prowConfig: `
+in_repo_config:
+  max_jobs:
+    "*": -1
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigBasePaths with relative path is accepted",
+			prowConfig: `
+in_repo_config:
+  base_paths:
+    org/repo: component-a
+`,
+			verify: func(c *Config) error {
+				if basePath := c.InRepoConfigBasePath("org/repo"); basePath != "component-a" {
+					return fmt.Errorf(`expected base path to be "component-a", was %q`, basePath)
+				}
+				return nil
+			},
+		},
+		{
+			name: "InRepoConfigFileNames with a path is rejected",
+			prowConfig: `
+in_repo_config:
+  file_names:
+    org/repo: ci/.prow
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigFileNames with an empty name is rejected",
+			prowConfig: `
+in_repo_config:
+  file_names:
+    org: ""
+`,
+			expectError: true,
+		},
+		{
+			name: "InRepoConfigFileNames with a file name is accepted",
+			prowConfig: `
+in_repo_config:
+  file_names:
+    org/repo: .ci
+`,
+			verify: func(c *Config) error {
+				if fileName := c.InRepoConfigFileName("org/repo"); fileName != ".ci" {
+					return fmt.Errorf(`expected file name to be ".ci", was %q`, fileName)
+				}
+				return nil
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -4469,6 +4726,389 @@ func TestInRepoConfigEnabled(t *testing.T) {
 	}
 }
 
+func TestInRepoConfigBasePath(t *testing.T) {
+	testCases := []struct {
+		name      string
+		basePaths map[string]string
+		expected  string
+	}{
+		{
+			name:      "Exact match",
+			basePaths: map[string]string{"org/repo": "repo-path", "org": "org-path", "*": "global-path"},
+			expected:  "repo-path",
+		},
+		{
+			name:      "Orgname matches",
+			basePaths: map[string]string{"org": "org-path", "*": "global-path"},
+			expected:  "org-path",
+		},
+		{
+			name:      "Global match",
+			basePaths: map[string]string{"other-org": "org-path", "*": "global-path"},
+			expected:  "global-path",
+		},
+		{
+			name:     "Repository root by default",
+			expected: "",
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{BasePaths: tc.basePaths}}}
+			if result := c.InRepoConfigBasePath("org/repo"); result != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigFileName(t *testing.T) {
+	testCases := []struct {
+		name      string
+		fileNames map[string]string
+		expected  string
+	}{
+		{
+			name:      "Exact match",
+			fileNames: map[string]string{"org/repo": "repo-name", "org": "org-name", "*": "global-name"},
+			expected:  "repo-name",
+		},
+		{
+			name:      "Orgname matches",
+			fileNames: map[string]string{"org": "org-name", "*": "global-name"},
+			expected:  "org-name",
+		},
+		{
+			name:      "Global match",
+			fileNames: map[string]string{"other-org": "org-name", "*": "global-name"},
+			expected:  "global-name",
+		},
+		{
+			name:     ".prow by default",
+			expected: ".prow",
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{FileNames: tc.fileNames}}}
+			if result := c.InRepoConfigFileName("org/repo"); result != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigMaxJobs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		maxJobs  map[string]int
+		expected int
+	}{
+		{
+			name:     "Exact match",
+			maxJobs:  map[string]int{"org/repo": 1, "org": 2, "*": 3},
+			expected: 1,
+		},
+		{
+			name:     "Orgname matches",
+			maxJobs:  map[string]int{"org": 2, "*": 3},
+			expected: 2,
+		},
+		{
+			name:     "Global match",
+			maxJobs:  map[string]int{"other-org": 2, "*": 3},
+			expected: 3,
+		},
+		{
+			name:     "Repo can lift the limit",
+			maxJobs:  map[string]int{"org/repo": 0, "*": 3},
+			expected: 0,
+		},
+		{
+			name:     "No limit by default",
+			expected: 0,
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{MaxJobs: tc.maxJobs}}}
+			if result := c.InRepoConfigMaxJobs("org/repo"); result != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigCloneDepth(t *testing.T) {
+	testCases := []struct {
+		name     string
+		depths   map[string]int
+		expected int
+	}{
+		{
+			name:     "Exact match",
+			depths:   map[string]int{"org/repo": 1, "org": 2, "*": 3},
+			expected: 1,
+		},
+		{
+			name:     "Orgname matches",
+			depths:   map[string]int{"org": 2, "*": 3},
+			expected: 2,
+		},
+		{
+			name:     "Global match",
+			depths:   map[string]int{"other-org": 2, "*": 3},
+			expected: 3,
+		},
+		{
+			name:     "Repo can clone the complete history",
+			depths:   map[string]int{"org/repo": 0, "*": 3},
+			expected: 0,
+		},
+		{
+			name:     "Complete history by default",
+			expected: 0,
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{CloneDepths: tc.depths}}}
+			if result := c.InRepoConfigCloneDepth("org/repo"); result != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigMergeRetryMethods(t *testing.T) {
+	testCases := []struct {
+		name     string
+		methods  map[string][]github.PullRequestMergeType
+		expected []github.PullRequestMergeType
+	}{
+		{
+			name:     "Exact match",
+			methods:  map[string][]github.PullRequestMergeType{"org/repo": {github.MergeSquash}, "org": {github.MergeMerge}, "*": nil},
+			expected: []github.PullRequestMergeType{github.MergeSquash},
+		},
+		{
+			name:     "Orgname matches",
+			methods:  map[string][]github.PullRequestMergeType{"org": {github.MergeMerge}, "*": {github.MergeSquash}},
+			expected: []github.PullRequestMergeType{github.MergeMerge},
+		},
+		{
+			name:     "Global match",
+			methods:  map[string][]github.PullRequestMergeType{"other-org": {github.MergeMerge}, "*": {github.MergeSquash}},
+			expected: []github.PullRequestMergeType{github.MergeSquash},
+		},
+		{
+			name: "No retries by default",
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{MergeRetryMethods: tc.methods}}}
+			if result := c.InRepoConfigMergeRetryMethods("org/repo"); !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigAllowedBranches(t *testing.T) {
+	testCases := []struct {
+		name     string
+		branches map[string][]string
+		expected []string
+	}{
+		{
+			name:     "Exact match",
+			branches: map[string][]string{"org/repo": {"main"}, "org": {"master"}, "*": {"release"}},
+			expected: []string{"main"},
+		},
+		{
+			name:     "Orgname matches",
+			branches: map[string][]string{"org": {"master"}, "*": {"release"}},
+			expected: []string{"master"},
+		},
+		{
+			name:     "Global match",
+			branches: map[string][]string{"other-org": {"master"}, "*": {"release"}},
+			expected: []string{"release"},
+		},
+		{
+			name: "All branches by default",
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{AllowedBranches: tc.branches}}}
+			if result := c.InRepoConfigAllowedBranches("org/repo"); !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigStrict(t *testing.T) {
+	testCases := []struct {
+		name     string
+		strict   map[string]bool
+		expected bool
+	}{
+		{
+			name:     "Exact match",
+			strict:   map[string]bool{"org/repo": true, "org": false, "*": false},
+			expected: true,
+		},
+		{
+			name:     "Orgname matches",
+			strict:   map[string]bool{"org": true, "*": false},
+			expected: true,
+		},
+		{
+			name:     "Global match",
+			strict:   map[string]bool{"other-org": false, "*": true},
+			expected: true,
+		},
+		{
+			name:   "Repo can be lenient",
+			strict: map[string]bool{"org/repo": false, "*": true},
+		},
+		{
+			name: "Lenient by default",
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{Strict: tc.strict}}}
+			if result := c.InRepoConfigStrict("org/repo"); result != tc.expected {
+				t.Errorf("Expected %t, got %t", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigRejectEmptyFiles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		reject   map[string]bool
+		expected bool
+	}{
+		{
+			name:     "Exact match",
+			reject:   map[string]bool{"org/repo": true, "org": false, "*": false},
+			expected: true,
+		},
+		{
+			name:     "Orgname matches",
+			reject:   map[string]bool{"org": true, "*": false},
+			expected: true,
+		},
+		{
+			name:     "Global match",
+			reject:   map[string]bool{"other-org": false, "*": true},
+			expected: true,
+		},
+		{
+			name:   "Repo can allow empty files",
+			reject: map[string]bool{"org/repo": false, "*": true},
+		},
+		{
+			name: "Empty files are allowed by default",
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{RejectEmptyFiles: tc.reject}}}
+			if result := c.InRepoConfigRejectEmptyFiles("org/repo"); result != tc.expected {
+				t.Errorf("Expected %t, got %t", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestInRepoConfigPodSecurityPolicy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policies map[string]InRepoConfigPodSecurityPolicy
+		expected *InRepoConfigPodSecurityPolicy
+	}{
+		{
+			name: "Exact match",
+			policies: map[string]InRepoConfigPodSecurityPolicy{
+				"org/repo": {AllowHostNetwork: true},
+				"org":      {AllowHostPID: true},
+				"*":        {},
+			},
+			expected: &InRepoConfigPodSecurityPolicy{AllowHostNetwork: true},
+		},
+		{
+			name: "Orgname matches",
+			policies: map[string]InRepoConfigPodSecurityPolicy{
+				"org": {AllowHostPID: true},
+				"*":   {},
+			},
+			expected: &InRepoConfigPodSecurityPolicy{AllowHostPID: true},
+		},
+		{
+			name: "Global match",
+			policies: map[string]InRepoConfigPodSecurityPolicy{
+				"other-org": {AllowHostPID: true},
+				"*":         {AllowPrivileged: true},
+			},
+			expected: &InRepoConfigPodSecurityPolicy{AllowPrivileged: true},
+		},
+		{
+			name: "No policy by default",
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{PodSecurityPolicies: tc.policies}}}
+			if diff := cmp.Diff(tc.expected, c.InRepoConfigPodSecurityPolicy("org/repo")); diff != "" {
+				t.Errorf("policy differs from expected: %s", diff)
+			}
+		})
+	}
+}
+
 func TestGetProwYAMLDoesNotCallRefGettersWhenInrepoconfigIsDisabled(t *testing.T) {
 	t.Parallel()
 
@@ -4645,6 +5285,91 @@ func TestInRepoConfigAllowsCluster(t *testing.T) {
 	}
 }
 
+func TestInRepoConfigSigningKey(t *testing.T) {
+	globalKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, ed25519.PublicKeySize))
+	orgKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, ed25519.PublicKeySize))
+	cfg := &Config{ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{SigningKeys: map[string]string{
+		"*":           globalKey,
+		"org":         orgKey,
+		"org/opt-out": "",
+	}}}}
+
+	testCases := []struct {
+		identifier string
+		expected   ed25519.PublicKey
+	}{
+		{identifier: "other/repo", expected: bytes.Repeat([]byte{1}, ed25519.PublicKeySize)},
+		{identifier: "org/repo", expected: bytes.Repeat([]byte{2}, ed25519.PublicKeySize)},
+		{identifier: "org/opt-out"},
+	}
+	for _, tc := range testCases {
+		if actual := cfg.InRepoConfigSigningKey(tc.identifier); !bytes.Equal(actual, tc.expected) {
+			t.Errorf("%s: expected key %x, got %x", tc.identifier, tc.expected, actual)
+		}
+	}
+}
+
+func TestInRepoConfigAllowsAgent(t *testing.T) {
+	testCases := []struct {
+		name           string
+		repoIdentifier string
+		allowedAgents  map[string][]string
+
+		expectedResult bool
+	}{
+		{
+			name:           "Nothing configured, everything allowed",
+			repoIdentifier: "foo/repo",
+			expectedResult: true,
+		},
+		{
+			name:           "Allowed on repolevel",
+			repoIdentifier: "foo/repo",
+			allowedAgents:  map[string][]string{"foo/repo": {"jenkins"}},
+			expectedResult: true,
+		},
+		{
+			name:           "Allowed for different repo",
+			repoIdentifier: "foo/repo",
+			allowedAgents:  map[string][]string{"bar/repo": {"jenkins"}},
+			expectedResult: false,
+		},
+		{
+			name:           "Allowed on orglevel",
+			repoIdentifier: "foo/repo",
+			allowedAgents:  map[string][]string{"foo": {"jenkins"}},
+			expectedResult: true,
+		},
+		{
+			name:           "Allowed globally",
+			repoIdentifier: "foo/repo",
+			allowedAgents:  map[string][]string{"*": {"jenkins"}},
+			expectedResult: true,
+		},
+		{
+			name:           "Only other agent allowed globally",
+			repoIdentifier: "foo/repo",
+			allowedAgents:  map[string][]string{"*": {"kubernetes"}},
+			expectedResult: false,
+		},
+	}
+
+	for idx := range testCases {
+		tc := testCases[idx]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := &Config{
+				ProwConfig: ProwConfig{InRepoConfig: InRepoConfig{AllowedAgents: tc.allowedAgents}},
+			}
+
+			if actual := cfg.InRepoConfigAllowsAgent("jenkins", tc.repoIdentifier); actual != tc.expectedResult {
+				t.Errorf("expected result %t, got result %t", tc.expectedResult, actual)
+			}
+		})
+	}
+}
+
 func TestGetDefaultDecorationConfigsThreadSafety(t *testing.T) {
 	const repo = "repo"
 	p := Plank{DefaultDecorationConfigs: map[string]*prowapi.DecorationConfig{
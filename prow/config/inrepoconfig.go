@@ -17,134 +17,2178 @@ limitations under the License.
 package config
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	yaml3 "gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
 	"k8s.io/test-infra/prow/git/v2"
+	"k8s.io/test-infra/prow/github"
 	"sigs.k8s.io/yaml"
 )
 
+// DefaultInRepoConfigFileName is the name of the in-repo config file without
+// its extension that is used if no other name is configured.
+const DefaultInRepoConfigFileName = ".prow"
+
+// inRepoConfigFailures counts the failures to get the in-repo config of a
+// repository by the step that failed.
+var inRepoConfigFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "inrepoconfig_failures",
+	Help: "Number of failures to get the in-repo config by org, repo and the step that failed.",
+}, []string{"org", "repo", "reason"})
+
+// inRepoConfigInFlight is the number of in-repo config reads that are
+// currently in progress by org.
+var inRepoConfigInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "inrepoconfig_in_flight",
+	Help: "Number of in-repo config reads that are currently in progress by org.",
+}, []string{"org"})
+
+// inRepoConfigJobs is the number of jobs in the in-repo config of a repository
+// by job type, as of the last time it was read successfully.
+var inRepoConfigJobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "inrepoconfig_jobs",
+	Help: "Number of jobs in the in-repo config by org, repo and job type, as of the last successful read.",
+}, []string{"org", "repo", "type"})
+
+// inRepoConfigGitVersion is 1 for the version of git that is used to read
+// in-repo config. It is detected when the first repository is cloned.
+var inRepoConfigGitVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "inrepoconfig_git_version",
+	Help: "Always 1, labeled with the version of git that is used to read in-repo config.",
+}, []string{"version"})
+
+func init() {
+	prometheus.MustRegister(inRepoConfigFailures)
+	prometheus.MustRegister(inRepoConfigInFlight)
+	prometheus.MustRegister(inRepoConfigJobs)
+	prometheus.MustRegister(inRepoConfigGitVersion)
+}
+
+// recordGitVersionOnce makes the git version only get detected once.
+var recordGitVersionOnce sync.Once
+
+// recordGitVersion sets inRepoConfigGitVersion for the version of git that
+// gitVersion returns. A failure is only logged.
+func recordGitVersion(log *logrus.Entry, gitVersion func() (string, error)) {
+	version, err := gitVersion()
+	if err != nil {
+		log.WithError(err).Warn("Failed to detect the git version.")
+		return
+	}
+	inRepoConfigGitVersion.WithLabelValues(version).Set(1)
+}
+
+// gitVersion returns the version of the git binary in the PATH, which the git
+// clients use.
+func gitVersion() (string, error) {
+	out, err := exec.Command("git", "version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run git version: %v %s", err, string(out))
+	}
+	return parseGitVersion(string(out))
+}
+
+// parseGitVersion returns the version in the output of git version, e.g.
+// "2.30.2" for "git version 2.30.2".
+func parseGitVersion(out string) (string, error) {
+	fields := strings.Fields(out)
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return "", fmt.Errorf("unexpected output of git version: %q", out)
+	}
+	return fields[2], nil
+}
+
 const (
-	inRepoConfigFileName = ".prow.yaml"
+	// signatureFileSuffix is appended to the name of an in-repo config file
+	// to get the name of the file with its detached signature.
+	signatureFileSuffix = ".sig"
+	// maxSignatureFileSize is the maximum size in bytes of a signature file.
+	maxSignatureFileSize = 1024
 )
 
+// inRepoConfigFileExtensions are the extensions of the files that are looked
+// up to get a ProwYAML, in order of precedence. Only the first file that
+// exists is read.
+var inRepoConfigFileExtensions = []string{".yaml", ".json"}
+
+// InRepoConfigPaths returns the paths relative to the repository root that
+// are looked up to get the in-repo config of a repository, in order of
+// precedence. Only the first one that exists is read.
+func InRepoConfigPaths(c *Config, orgRepo OrgRepo) []string {
+	return inRepoConfigPaths(c.InRepoConfigBasePath(orgRepo.String()), c.InRepoConfigFileName(orgRepo.String()))
+}
+
+// inRepoConfigPaths returns the paths of the in-repo config files with the
+// given name without extension in basePath. An empty name means the default.
+func inRepoConfigPaths(basePath, fileName string) []string {
+	if fileName == "" {
+		fileName = DefaultInRepoConfigFileName
+	}
+	paths := make([]string, 0, len(inRepoConfigFileExtensions))
+	for _, extension := range inRepoConfigFileExtensions {
+		paths = append(paths, path.Join(basePath, fileName+extension))
+	}
+	return paths
+}
+
 // ProwYAML represents the content of a .prow.yaml file
 // used to version Presubmits and Postsubmits inside the tested repo.
 type ProwYAML struct {
-	Presubmits  []Presubmit  `json:"presubmits"`
-	Postsubmits []Postsubmit `json:"postsubmits"`
+	Templates   []JobTemplate `json:"templates,omitempty"`
+	Presubmits  []Presubmit   `json:"presubmits"`
+	Postsubmits []Postsubmit  `json:"postsubmits"`
+	// Include lists other files whose templates and jobs are added to those
+	// of this file. Paths are relative to the directory of this file and
+	// must be inside the repository. Included files may include other files.
+	Include []string `json:"include,omitempty"`
+	// DecorationConfig is the default decoration config of the decorated jobs
+	// of this file and the files it includes. Fields set on a job or its
+	// template take precedence over it, and it takes precedence over the
+	// default decoration config of Prow. It can't be set in included files and
+	// doesn't apply to the jobs of the base in-repo config.
+	DecorationConfig *prowapi.DecorationConfig `json:"decoration_config,omitempty"`
+
+	// ProwIgnored is ignored by Prow. It can be used to keep additional data
+	// for other tools in the same file. Use UnmarshalProwIgnored to read it.
+	ProwIgnored *json.RawMessage `json:"prow_ignored,omitempty"`
+
+	// SourcePath is the path of the file the ProwYAML was read from,
+	// relative to the root of the repository. It is empty if no in-repo
+	// config file exists.
+	SourcePath string `json:"-"`
+	// Files are the paths of all files that were read to get the ProwYAML,
+	// including included files, symlink targets and signatures, relative to
+	// the root of the repository.
+	Files []string `json:"-"`
+	// Defaulted is set once DefaultAndValidateProwYAML defaulted the jobs, so
+	// they are not defaulted again.
+	Defaulted bool `json:"-"`
+}
+
+// Found returns whether the ProwYAML was read from an in-repo config file. It
+// is false if the repository has none, which is otherwise indistinguishable
+// from a file that defines no jobs.
+func (p *ProwYAML) Found() bool {
+	return p.SourcePath != ""
+}
+
+// UnmarshalProwIgnored unmarshals the prow_ignored section into v. It does
+// nothing if there is no such section.
+func (p *ProwYAML) UnmarshalProwIgnored(v interface{}) error {
+	if p.ProwIgnored == nil {
+		return nil
+	}
+	if err := json.Unmarshal(*p.ProwIgnored, v); err != nil {
+		return fmt.Errorf("failed to unmarshal prow_ignored: %v", err)
+	}
+	return nil
+}
+
+// JobTemplate is a named, partial job that Presubmits and Postsubmits of the
+// same ProwYAML can reference by setting their Template field. The name of
+// the template is the name of its JobBase.
+type JobTemplate struct {
+	JobBase
 }
 
 // ProwYAMLGetter is used to retrieve a ProwYAML. Tests should provide
-// their own implementation and set that on the Config.
+// their own implementation and set that on the Config. The identifier of the
+// repository is either "org/repo" or a clone URL, see InRepoConfigOrgRepo.
 type ProwYAMLGetter func(c *Config, gc git.ClientFactory, identifier, baseSHA string, headSHAs ...string) (*ProwYAML, error)
 
+// ProwYAMLTransform modifies the in-repo config of the repository identified
+// by identifier after it was read, e.g. to apply org-specific conventions. It
+// may modify p and return it or return a different ProwYAML.
+type ProwYAMLTransform func(p *ProwYAML, identifier string) (*ProwYAML, error)
+
+// InRepoConfigOrgRepo returns the OrgRepo of the repository identified by
+// identifier, which is either "org/repo" or the clone URL of a repository on
+// an arbitrary git host, e.g. "https://git.example.com/team/sub/project". For
+// a URL, the repo is its last path element and the org is the rest of it, so
+// the URL is OrgRepo.String(). Per-repository settings for a URL can only be
+// configured with the URL itself or "*" as key. Git clients clone a URL org
+// without any credentials. URLs that contain credentials are rejected, as the
+// identifier ends up in logs and metrics.
+func InRepoConfigOrgRepo(identifier string) (OrgRepo, error) {
+	if !strings.Contains(identifier, "://") {
+		orgRepo := NewOrgRepo(identifier)
+		if orgRepo == nil || orgRepo.Repo == "" {
+			return OrgRepo{}, fmt.Errorf("didn't get two results when splitting repo identifier %q", identifier)
+		}
+		return *orgRepo, nil
+	}
+	u, err := url.Parse(identifier)
+	if err != nil {
+		return OrgRepo{}, fmt.Errorf("invalid repo URL %q: %v", identifier, err)
+	}
+	if u.User != nil {
+		return OrgRepo{}, errors.New("repo URL must not contain credentials")
+	}
+	// Only file URLs of local repositories don't have a host.
+	if (u.Host == "" && u.Scheme != "file") || u.RawQuery != "" || u.Fragment != "" {
+		return OrgRepo{}, fmt.Errorf("repo URL %q must consist of a scheme, a host and a path", identifier)
+	}
+	for _, element := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+		if element == "" || element == "." || element == ".." {
+			return OrgRepo{}, fmt.Errorf("repo URL %q must have a path without empty, \".\" or \"..\" elements", identifier)
+		}
+	}
+	idx := strings.LastIndex(identifier, "/")
+	return OrgRepo{Org: identifier[:idx], Repo: identifier[idx+1:]}, nil
+}
+
+// ProwYAMLGetterWithContext is a ProwYAMLGetter that stops once the passed
+// context is done.
+type ProwYAMLGetterWithContext func(ctx context.Context, c *Config, gc git.ClientFactory, identifier, baseSHA string, headSHAs ...string) (*ProwYAML, error)
+
 // Verify defaultProwYAMLGetter is a ProwYAMLGetter
 var _ ProwYAMLGetter = defaultProwYAMLGetter
 
+// Verify DefaultProwYAMLGetterWithContext is a ProwYAMLGetterWithContext
+var _ ProwYAMLGetterWithContext = DefaultProwYAMLGetterWithContext
+
 func defaultProwYAMLGetter(
 	c *Config,
 	gc git.ClientFactory,
 	identifier string,
 	baseSHA string,
 	headSHAs ...string) (*ProwYAML, error) {
+	return DefaultProwYAMLGetterWithContext(context.Background(), c, gc, identifier, baseSHA, headSHAs...)
+}
+
+// DefaultProwYAMLGetterWithContext is the default ProwYAMLGetter, with
+// support for cancellation. Git operations that already run when ctx is done
+// can not be aborted, but no further ones are started and ctx.Err() is returned
+// right away. The clone of the repository is cleaned up in the background then.
+func DefaultProwYAMLGetterWithContext(
+	ctx context.Context,
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	baseSHA string,
+	headSHAs ...string) (*ProwYAML, error) {
+	prowYAML, _, err := DefaultProwYAMLGetterWithHead(ctx, c, gc, identifier, baseSHA, headSHAs...)
+	return prowYAML, err
+}
+
+// ReadRequest identifies the in-repo config to read for one repository in a
+// call of GetProwYAMLs.
+type ReadRequest struct {
+	// Identifier is the identifier of the repository, see InRepoConfigOrgRepo.
+	Identifier string
+	BaseSHA    string
+	HeadSHAs   []string
+}
+
+// prowYAMLBatchWorkers is the maximum number of in-repo configs GetProwYAMLs
+// reads at the same time.
+const prowYAMLBatchWorkers = 8
+
+// GetProwYAMLs reads the in-repo config of every request concurrently with
+// DefaultProwYAMLGetterWithContext, so the cache is used as usual. The results
+// and errors are returned by the identifier of the request. A failed read
+// doesn't affect the others. Once ctx is done, no further reads are started
+// and the error of every unfinished request is ctx.Err(). If a repository is
+// requested more than once, none of its requests are read.
+func GetProwYAMLs(ctx context.Context, c *Config, gc git.ClientFactory, requests []ReadRequest) (map[string]*ProwYAML, map[string]error) {
+	return getProwYAMLs(ctx, prowYAMLBatchWorkers, requests, func(ctx context.Context, r ReadRequest) (*ProwYAML, error) {
+		return DefaultProwYAMLGetterWithContext(ctx, c, gc, r.Identifier, r.BaseSHA, r.HeadSHAs...)
+	})
+}
+
+func getProwYAMLs(ctx context.Context, workers int, requests []ReadRequest, get func(context.Context, ReadRequest) (*ProwYAML, error)) (map[string]*ProwYAML, map[string]error) {
+	results, errs := map[string]*ProwYAML{}, map[string]error{}
+	counts := map[string]int{}
+	for _, r := range requests {
+		counts[r.Identifier]++
+	}
+	var queue []ReadRequest
+	for _, r := range requests {
+		if counts[r.Identifier] > 1 {
+			errs[r.Identifier] = fmt.Errorf("repository %q was requested %d times", r.Identifier, counts[r.Identifier])
+			continue
+		}
+		queue = append(queue, r)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan ReadRequest)
+	for i := 0; i < workers && i < len(queue); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				prowYAML, err := get(ctx, r)
+				lock.Lock()
+				if err != nil {
+					errs[r.Identifier] = err
+				} else {
+					results[r.Identifier] = prowYAML
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	sent := 0
+	for _, r := range queue {
+		// A select picks randomly among ready cases, so check ctx first to
+		// not start any reads after it is done.
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case work <- r:
+			sent++
+			continue
+		}
+		break
+	}
+	close(work)
+	if sent < len(queue) {
+		lock.Lock()
+		for _, r := range queue[sent:] {
+			errs[r.Identifier] = ctx.Err()
+		}
+		lock.Unlock()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// DefaultProwYAMLGetterWithHead is like DefaultProwYAMLGetterWithContext, but
+// additionally returns the SHA of the commit the ProwYAML was read from, i.e.
+// the result of merging headSHAs into baseSHA. It is empty if the in-repo
+// config was ignored because baseSHA is on no allowed branch and headSHAs
+// are set.
+func DefaultProwYAMLGetterWithHead(
+	ctx context.Context,
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	baseSHA string,
+	headSHAs ...string) (*ProwYAML, string, error) {
+	return prowYAMLGetterWithContext(ctx, clock.RealClock{}, prowYAMLGetterOpts{}, c, gc, identifier, baseSHA, headSHAs...)
+}
+
+// DefaultProwYAMLGetterForRef gets the ProwYAML as it is at the commit ref
+// points to, e.g. a tag or a branch, without merging anything into it. ref is
+// resolved in a fresh clone of the repository, so branches other than the
+// default one must be given as remote-tracking branches, e.g.
+// "origin/release-1.0". Ambiguous refs are rejected. The SHA of the commit is
+// returned as well.
+func DefaultProwYAMLGetterForRef(
+	ctx context.Context,
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	ref string) (*ProwYAML, string, error) {
+	return prowYAMLGetterWithContext(ctx, clock.RealClock{}, prowYAMLGetterOpts{baseIsRef: true}, c, gc, identifier, ref)
+}
+
+// ErrPatchNotApplicable is returned by DefaultProwYAMLGetterWithPatch if the
+// patch can't be applied to the base SHA.
+var ErrPatchNotApplicable = errors.New("patch does not apply")
+
+// DefaultProwYAMLGetterWithPatch gets the ProwYAML as it is after patch, a
+// unified diff as output by `git diff` or `git format-patch`, is applied to
+// baseSHA. This allows reading the in-repo config of changes that were never
+// pushed. Nothing is merged and the patch is not committed, so the returned
+// SHA is the one of baseSHA. The result is never cached. If the patch doesn't
+// apply, an error wrapping ErrPatchNotApplicable is returned.
+func DefaultProwYAMLGetterWithPatch(
+	ctx context.Context,
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	baseSHA string,
+	patch []byte) (*ProwYAML, string, error) {
+	if len(patch) == 0 {
+		return nil, "", errors.New("patch must not be empty")
+	}
+	return prowYAMLGetterWithContext(ctx, clock.RealClock{}, prowYAMLGetterOpts{patch: patch}, c, gc, identifier, baseSHA)
+}
+
+// DefaultProwYAMLGetterForJobType returns a ProwYAMLGetter that works like the
+// default one, but only returns jobs of the given type, which must be
+// prowapi.PresubmitJob or prowapi.PostsubmitJob. Jobs of the other type are
+// dropped right after reading, so they are neither defaulted nor validated.
+func DefaultProwYAMLGetterForJobType(jobType prowapi.ProwJobType) ProwYAMLGetter {
+	return func(c *Config, gc git.ClientFactory, identifier, baseSHA string, headSHAs ...string) (*ProwYAML, error) {
+		prowYAML, _, err := prowYAMLGetterWithContext(context.Background(), clock.RealClock{}, prowYAMLGetterOpts{jobType: jobType}, c, gc, identifier, baseSHA, headSHAs...)
+		return prowYAML, err
+	}
+}
+
+// prowYAMLGetterOpts are the options of prowYAMLGetter that only some of the
+// exported getters use.
+type prowYAMLGetterOpts struct {
+	// jobType makes only jobs of that type get read if it is set.
+	jobType prowapi.ProwJobType
+	// baseIsRef makes the base SHA get resolved as a git ref in the clone.
+	// Head SHAs are not supported then.
+	baseIsRef bool
+	// patch is applied to the working tree of the base SHA before reading if
+	// it is set. Head SHAs are not supported then.
+	patch []byte
+}
+
+// prowYAMLGetterGroup deduplicates concurrent identical calls of prowYAMLGetter.
+var prowYAMLGetterGroup singleflight.Group
+
+// prowYAMLGetterWithContext implements DefaultProwYAMLGetterWithHead. clk is
+// used for all timing, so tests can inject a fake one. Concurrent calls with
+// the same arguments share a single call of prowYAMLGetter, which runs with
+// the context of the first of them. Callers that joined it get a copy of its
+// result, unless it failed because that context was done while theirs isn't.
+// Then they make a new call.
+func prowYAMLGetterWithContext(
+	ctx context.Context,
+	clk clock.Clock,
+	opts prowYAMLGetterOpts,
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	baseSHA string,
+	headSHAs ...string) (*ProwYAML, string, error) {
+
+	type result struct {
+		prowYAML *ProwYAML
+		head     string
+	}
+	// The config and client are part of the key, so calls with different ones
+	// are never shared.
+	key := fmt.Sprintf("%p:%p:%s:%t:%s:%s:%s", c, gc, opts.jobType, opts.baseIsRef, identifier, baseSHA, strings.Join(headSHAs, ","))
+	if opts.patch != nil {
+		key += fmt.Sprintf(":%x", sha256.Sum256(opts.patch))
+	}
+	for {
+		results := prowYAMLGetterGroup.DoChan(key, func() (interface{}, error) {
+			prowYAML, head, err := prowYAMLGetter(ctx, clk, opts, c, gc, identifier, baseSHA, headSHAs...)
+			return result{prowYAML: prowYAML, head: head}, err
+		})
+
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case r := <-results:
+			if r.Err != nil {
+				if r.Shared && ctx.Err() == nil && (errors.Is(r.Err, context.Canceled) || errors.Is(r.Err, context.DeadlineExceeded)) {
+					continue
+				}
+				return nil, "", r.Err
+			}
+			res := r.Val.(result)
+			if !r.Shared {
+				return res.prowYAML, res.head, nil
+			}
+			prowYAML, err := copyProwYAML(res.prowYAML)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to copy shared ProwYAML: %v", err)
+			}
+			return prowYAML, res.head, nil
+		}
+	}
+}
+
+// DefaultProwYAMLGetterForSHA gets the ProwYAML as it is at a single commit of
+// the repository, without merging anything into it. Unlike resolving the
+// ProwYAML for a pull request, this can't fail because of merge conflicts, so
+// it is suited for postsubmits and for linting a single commit.
+func DefaultProwYAMLGetterForSHA(
+	ctx context.Context,
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	sha string) (*ProwYAML, error) {
+	// Without any head SHAs, the sha is only checked out.
+	return DefaultProwYAMLGetterWithContext(ctx, c, gc, identifier, sha)
+}
+
+// InRepoConfigChanged returns whether a change of changedFiles, which are
+// relative to the root of the repository, can make the in-repo config of the
+// repository differ from p. p must have been read from the same repository.
+func InRepoConfigChanged(c *Config, orgRepo OrgRepo, p *ProwYAML, changedFiles []string) bool {
+	configFiles := sets.NewString(p.Files...)
+	for _, configPath := range InRepoConfigPaths(c, orgRepo) {
+		configFiles.Insert(configPath, configPath+signatureFileSuffix)
+	}
+	for _, changedFile := range changedFiles {
+		if configFiles.Has(changedFile) {
+			return true
+		}
+		// A changed directory symlink can change the files below it.
+		for configFile := range configFiles {
+			if strings.HasPrefix(configFile, changedFile+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProwYAMLForChangedFiles gets the ProwYAML for merging headSHAs into baseSHA
+// like the default ProwYAMLGetter does, unless none of changedFiles can affect
+// it. Then baseProwYAML, the ProwYAML at baseSHA, is returned as it is, which
+// saves cloning and merging the repository. This relies on changedFiles being
+// the complete list of the files that headSHAs change, relative to the root of
+// the repository, including deleted and renamed files. baseProwYAML must have
+// been read with the same config.
+func ProwYAMLForChangedFiles(
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	baseSHA string,
+	baseProwYAML *ProwYAML,
+	changedFiles []string,
+	headSHAs ...string) (*ProwYAML, error) {
+	orgRepo, err := InRepoConfigOrgRepo(identifier)
+	if err == nil && baseProwYAML != nil && !InRepoConfigChanged(c, orgRepo, baseProwYAML, changedFiles) {
+		return baseProwYAML, nil
+	}
+	return defaultProwYAMLGetter(c, gc, identifier, baseSHA, headSHAs...)
+}
+
+func prowYAMLGetter(
+	ctx context.Context,
+	clk clock.Clock,
+	opts prowYAMLGetterOpts,
+	c *Config,
+	gc git.ClientFactory,
+	identifier string,
+	baseSHA string,
+	headSHAs ...string) (*ProwYAML, string, error) {
+
+	orgRepo, err := InRepoConfigOrgRepo(identifier)
+	if err != nil {
+		return nil, "", err
+	}
+	inFlight := inRepoConfigInFlight.WithLabelValues(orgRepo.Org)
+	inFlight.Inc()
+	defer inFlight.Dec()
 
-	log := logrus.WithField("repo", identifier)
-	log.Debugf("Attempting to get %q.", inRepoConfigFileName)
+	log := logrus.WithFields(logrus.Fields{"repo": identifier, "base-sha": baseSHA, "head-shas": headSHAs})
+	log.Debug("Attempting to get inrepoconfig.")
 
 	if gc == nil {
 		log.Error("defaultProwYAMLGetter was called with a nil git client")
-		return nil, errors.New("gitClient is nil")
+		return nil, "", errors.New("gitClient is nil")
+	}
+
+	if opts.baseIsRef {
+		if err := validateRef(baseSHA); err != nil {
+			return nil, "", fmt.Errorf("invalid base ref: %v", err)
+		}
+	} else if err := validateSHA(baseSHA); err != nil {
+		return nil, "", fmt.Errorf("invalid base SHA: %v", err)
+	}
+	for _, headSHA := range headSHAs {
+		if err := validateSHA(headSHA); err != nil {
+			return nil, "", fmt.Errorf("invalid head SHA: %v", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var negativeCacheKey string
+	// Refs can move, so what they point to is never cached. Neither is the
+	// result of applying a patch.
+	if !opts.baseIsRef && opts.patch == nil && c.InRepoConfig.NegativeCacheTTL != nil && c.InRepoConfig.NegativeCacheTTL.Duration > 0 {
+		negativeCacheKey = fmt.Sprintf("%s:%s:%s:%s", identifier, strings.Join(InRepoConfigPaths(c, orgRepo), ","), baseSHA, strings.Join(headSHAs, ","))
+		if head, ok := defaultNegativeProwYAMLCache.get(negativeCacheKey, clk.Now()); ok {
+			log.Debug("Repository is known to have no in-repo config at these SHAs, not cloning it.")
+			prowYAML := &ProwYAML{}
+			if reason, err := defaultAndValidateReadProwYAML(c, prowYAML, identifier); err != nil {
+				inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, reason).Inc()
+				return nil, "", err
+			}
+			return prowYAML, head, nil
+		}
 	}
 
-	orgRepo := *NewOrgRepo(identifier)
-	if orgRepo.Repo == "" {
-		return nil, fmt.Errorf("didn't get two results when splitting repo identifier %q", identifier)
+	var cloneTimeout, cloneRetryDelay time.Duration
+	if c.InRepoConfig.CloneTimeout != nil {
+		cloneTimeout = c.InRepoConfig.CloneTimeout.Duration
+	}
+	if c.InRepoConfig.CloneRetryDelay != nil {
+		cloneRetryDelay = c.InRepoConfig.CloneRetryDelay.Duration
+	}
+	allowedBranches := c.InRepoConfigAllowedBranches(identifier)
+	// Shallow clones have no remote-tracking branches to check the base SHA
+	// against.
+	if depth := c.InRepoConfigCloneDepth(identifier); depth > 0 && !opts.baseIsRef && len(allowedBranches) == 0 {
+		if sgc, ok := gc.(git.ShallowClientFactory); ok {
+			log = log.WithField("clone-depth", depth)
+			gc = &shallowClientFactory{ShallowClientFactory: sgc, log: log, depth: depth, baseSHA: baseSHA, headSHAs: headSHAs}
+		}
 	}
-	repo, err := gc.ClientFor(orgRepo.Org, orgRepo.Repo)
+	repo, err := clientForWithRetries(ctx, clk, log, gc, orgRepo, cloneTimeout, c.InRepoConfig.CloneAttempts, cloneRetryDelay)
 	if err != nil {
-		return nil, fmt.Errorf("failed to clone repo for %q: %v", identifier, err)
+		inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "clone").Inc()
+		return nil, "", fmt.Errorf("failed to clone repo for %q: %v", identifier, err)
 	}
+	recordGitVersionOnce.Do(func() { recordGitVersion(log, gitVersion) })
 	defer func() {
 		if err := repo.Clean(); err != nil {
 			log.WithError(err).Error("Failed to clean up repo.")
 		}
 	}()
+	// The clone doesn't stop when the context is done, so it is checked after
+	// it, like before each of the following steps that take long.
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
 
-	if err := repo.Config("user.name", "prow"); err != nil {
-		return nil, err
+	userName, userEmail := c.InRepoConfig.GitUserName, c.InRepoConfig.GitUserEmail
+	if userName == "" {
+		userName = DefaultInRepoConfigGitUserName
 	}
-	if err := repo.Config("user.email", "prow@localhost"); err != nil {
-		return nil, err
+	if userEmail == "" {
+		userEmail = DefaultInRepoConfigGitUserEmail
 	}
-	if err := repo.Config("commit.gpgsign", "false"); err != nil {
-		return nil, err
+	if err := repo.Config("user.name", userName); err != nil {
+		return nil, "", err
+	}
+	if err := repo.Config("user.email", userEmail); err != nil {
+		return nil, "", err
+	}
+	if err := repo.Config("commit.gpgsign", strconv.FormatBool(c.InRepoConfig.GitCommitGPGSign)); err != nil {
+		return nil, "", err
 	}
 
-	mergeMethod := c.Tide.MergeMethod(orgRepo)
-	log.Debugf("Using merge strategy %q.", mergeMethod)
-	if err := repo.MergeAndCheckout(baseSHA, string(mergeMethod), headSHAs...); err != nil {
-		return nil, fmt.Errorf("failed to merge: %v", err)
+	if opts.baseIsRef {
+		ref := baseSHA
+		if baseSHA, err = resolveRef(repo, ref); err != nil {
+			inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "resolve_ref").Inc()
+			return nil, "", fmt.Errorf("failed to resolve %q: %w", ref, err)
+		}
+		log = log.WithField("base-sha", baseSHA)
+		log.WithField("ref", ref).Debug("Resolved ref.")
 	}
 
-	prowYAMLFilePath := path.Join(repo.Directory(), inRepoConfigFileName)
-	if _, err := os.Stat(prowYAMLFilePath); err != nil {
-		if os.IsNotExist(err) {
-			log.Debugf("File %q does not exist.", inRepoConfigFileName)
-			return &ProwYAML{}, nil
+	if len(allowedBranches) > 0 {
+		branches, err := repo.BranchesContaining(baseSHA)
+		if err != nil {
+			if sha := missingCommit(repo, []string{baseSHA}); sha != "" {
+				inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "sha_not_found").Inc()
+				return nil, "", fmt.Errorf("failed to resolve the branches of the base SHA: %w: %s", ErrSHANotFound, sha)
+			}
+			inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "resolve_branch").Inc()
+			return nil, "", fmt.Errorf("failed to resolve the branches of the base SHA: %v", err)
+		}
+		if !sets.NewString(allowedBranches...).HasAny(branches...) {
+			log.WithField("branches", branches).Debug("Base SHA is on no branch whose in-repo config is allowed, ignoring it.")
+			prowYAML := &ProwYAML{}
+			if reason, err := defaultAndValidateReadProwYAML(c, prowYAML, identifier); err != nil {
+				inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, reason).Inc()
+				return nil, "", err
+			}
+			// Nothing was merged, so there is only a head if there are no
+			// head SHAs.
+			var head string
+			if len(headSHAs) == 0 {
+				head = baseSHA
+			}
+			return prowYAML, head, nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var head string
+	var files prowYAMLFiles
+	// Without head SHAs there is nothing to merge, so the files are read from
+	// the git objects of the base SHA, which saves checking it out. Resolving
+	// symlinks or applying a patch needs a checkout, though.
+	if objects, ok := repo.(git.ObjectReader); ok && len(headSHAs) == 0 && opts.patch == nil && !c.InRepoConfig.AllowSymlinks {
+		log.Debug("Reading in-repo config from the git objects of the base SHA.")
+		if head, err = repo.RevParse(baseSHA + "^{commit}"); err != nil {
+			inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "sha_not_found").Inc()
+			return nil, "", fmt.Errorf("failed to resolve base SHA: %w: %s", ErrSHANotFound, baseSHA)
+		}
+		head = strings.TrimSpace(head)
+		files = &objectFiles{repo: objects, sha: head, infos: map[string]os.FileInfo{}}
+	} else {
+		if err := mergeAndCheckout(ctx, log, c, repo, identifier, orgRepo, baseSHA, headSHAs...); err != nil {
+			return nil, "", err
+		}
+		if head, err = verifyCheckout(repo, InRepoConfigPaths(c, orgRepo), baseSHA, headSHAs...); err != nil {
+			inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "verify_checkout").Inc()
+			return nil, "", fmt.Errorf("checkout is not in the expected state: %v", err)
+		}
+		if opts.patch != nil {
+			if err := applyPatch(repo, opts.patch); err != nil {
+				inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "apply_patch").Inc()
+				return nil, "", err
+			}
+			log.Debug("Applied patch.")
+		}
+		files = dirFiles(repo.Directory())
+	}
+	log = log.WithField("head", head)
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var treeSHA string
+	// The tree of head doesn't contain the changes of a patch.
+	if c.InRepoConfig.CacheSize > 0 && opts.patch == nil {
+		if treeSHA, err = repo.RevParse(head + "^{tree}"); err != nil {
+			log.WithError(err).Warn("Failed to get the tree SHA, not using the cache.")
 		}
-		return nil, fmt.Errorf("failed to check if file %q exists: %v", inRepoConfigFileName, err)
 	}
 
-	bytes, err := ioutil.ReadFile(prowYAMLFilePath)
+	prowYAML, reason, err := prowYAMLFromFiles(log, c, files, identifier, treeSHA, opts.jobType)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read %q: %v", inRepoConfigFileName, err)
+		inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, reason).Inc()
+		return nil, "", err
 	}
 
-	prowYAML := &ProwYAML{}
-	if err := yaml.Unmarshal(bytes, prowYAML); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal %q: %v", inRepoConfigFileName, err)
+	if negativeCacheKey != "" && !prowYAML.Found() {
+		now := clk.Now()
+		defaultNegativeProwYAMLCache.add(negativeCacheKey, head, now, now.Add(c.InRepoConfig.NegativeCacheTTL.Duration))
 	}
 
-	if err := DefaultAndValidateProwYAML(c, prowYAML, identifier); err != nil {
-		return nil, err
+	// Jobs of a type that was not read are not counted.
+	if opts.jobType != prowapi.PostsubmitJob {
+		inRepoConfigJobs.WithLabelValues(orgRepo.Org, orgRepo.Repo, string(prowapi.PresubmitJob)).Set(float64(len(prowYAML.Presubmits)))
+	}
+	if opts.jobType != prowapi.PresubmitJob {
+		inRepoConfigJobs.WithLabelValues(orgRepo.Org, orgRepo.Repo, string(prowapi.PostsubmitJob)).Set(float64(len(prowYAML.Postsubmits)))
 	}
 
-	log.Debugf("Successfully got %d presubmits and %d postsubmits from %q.", len(prowYAML.Presubmits), len(prowYAML.Postsubmits), inRepoConfigFileName)
-	return prowYAML, nil
+	log.Debugf("Successfully got %d presubmits and %d postsubmits.", len(prowYAML.Presubmits), len(prowYAML.Postsubmits))
+	return prowYAML, head, nil
 }
 
-func DefaultAndValidateProwYAML(c *Config, p *ProwYAML, identifier string) error {
-	if err := defaultPresubmits(p.Presubmits, c, identifier); err != nil {
-		return err
+// applyPatch applies patch to the working tree of repo. It is written to a
+// temporary file outside of the working tree for that.
+func applyPatch(repo git.RepoClient, patch []byte) error {
+	f, err := ioutil.TempFile("", "inrepoconfig-patch")
+	if err != nil {
+		return fmt.Errorf("failed to create patch file: %v", err)
 	}
-	if err := defaultPostsubmits(p.Postsubmits, c, identifier); err != nil {
-		return err
+	defer os.Remove(f.Name())
+	_, err = f.Write(patch)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	if err := validatePresubmits(append(p.Presubmits, c.PresubmitsStatic[identifier]...), c.PodNamespace); err != nil {
-		return err
+	if err != nil {
+		return fmt.Errorf("failed to write patch file: %v", err)
+	}
+	if err := repo.Apply(f.Name()); err != nil {
+		return fmt.Errorf("%w: %v", ErrPatchNotApplicable, err)
+	}
+	return nil
+}
+
+func validateRef(ref string) error {
+	if ref == "" {
+		return errors.New("must not be empty")
+	}
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("%q must not start with a dash", ref)
+	}
+	return nil
+}
+
+// resolveRef returns the SHA of the commit ref points to in repo. Refs that
+// git considers ambiguous, e.g. a branch and a tag with the same name, are
+// rejected.
+func resolveRef(repo git.RepoClient, ref string) (string, error) {
+	out, err := repo.RevParse(ref + "^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSHANotFound, err)
+	}
+	// Warnings are part of the output.
+	if strings.Contains(out, "is ambiguous") {
+		return "", fmt.Errorf("ref %q is ambiguous", ref)
+	}
+	sha := strings.TrimSpace(out)
+	if !shaRegex.MatchString(sha) {
+		return "", fmt.Errorf("unexpected output %q", sha)
+	}
+	return sha, nil
+}
+
+// ErrSHANotFound is returned by the default ProwYAMLGetter if the base SHA or
+// one of the head SHAs doesn't exist in the repository. Unlike most other
+// errors, retrying doesn't help then.
+var ErrSHANotFound = errors.New("commit not found")
+
+// missingCommit returns the first of shas that is not a commit in repo. It is
+// empty if all of them are.
+func missingCommit(repo git.RepoClient, shas []string) string {
+	for _, sha := range shas {
+		if _, err := repo.RevParse(sha + "^{commit}"); err != nil {
+			return sha
+		}
+	}
+	return ""
+}
+
+// verifyCheckout makes sure the working tree of repo is in the state
+// MergeAndCheckout should have left it in, so a stale or incomplete working
+// tree doesn't silently result in a wrong ProwYAML. If no heads were merged,
+// baseSHA must be checked out. Each of the in-repo config files configPaths
+// must exist in the working tree if and only if it exists in the checked out
+// commit. The SHA of the checked out commit is returned.
+func verifyCheckout(repo git.RepoClient, configPaths []string, baseSHA string, headSHAs ...string) (string, error) {
+	head, err := repo.RevParse("HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to get HEAD: %v", err)
+	}
+	head = strings.TrimSpace(head)
+	if len(headSHAs) == 0 {
+		base, err := repo.RevParse(baseSHA)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %q: %v", baseSHA, err)
+		}
+		if base = strings.TrimSpace(base); head != base {
+			return "", fmt.Errorf("expected %s to be checked out, but HEAD is %s", base, head)
+		}
+	}
+	for _, fileName := range configPaths {
+		_, err := repo.RevParse("HEAD:" + fileName)
+		inCommit := err == nil
+		_, err = os.Lstat(filepath.Join(repo.Directory(), filepath.FromSlash(fileName)))
+		inWorkingTree := err == nil
+		if inCommit != inWorkingTree {
+			return "", fmt.Errorf("file %q exists in HEAD: %t, exists in the working tree: %t", fileName, inCommit, inWorkingTree)
+		}
+	}
+	return head, nil
+}
+
+// ProwYAMLFromDir gets the ProwYAML of the repository identified by identifier
+// from dir, which must already contain its checkout. The result is the same
+// the default ProwYAMLGetter returns after it cloned and merged the
+// repository, so it can be used where a checkout already exists.
+func ProwYAMLFromDir(c *Config, dir, identifier string) (*ProwYAML, error) {
+	prowYAML, _, err := prowYAMLFromFiles(logrus.WithField("repo", identifier), c, dirFiles(dir), identifier, "", "")
+	return prowYAML, err
+}
+
+// ErrStopReadingProwYAML can be returned by the function passed to
+// VisitProwYAML to stop reading without an error.
+var ErrStopReadingProwYAML = errors.New("stop reading in-repo config")
+
+// VisitProwYAML reads the in-repo config of the repository identified by
+// identifier from dir, which must already contain its checkout, and calls visit
+// with the content of every file right after it was read, before the files it
+// includes. Unlike ProwYAMLFromDir, the templates and jobs of all files are
+// never kept in memory at once, so callers looking for a single job can stop
+// early. The jobs are neither defaulted nor validated. If visit returns
+// ErrStopReadingProwYAML, no further files are read and nil is returned.
+func VisitProwYAML(c *Config, dir, identifier string, visit func(fileName string, p *ProwYAML) error) error {
+	opts := prowYAMLReadOpts{
+		basePath:      c.InRepoConfigBasePath(identifier),
+		fileName:      c.InRepoConfigFileName(identifier),
+		strict:        c.InRepoConfigStrict(identifier),
+		maxFileSize:   c.InRepoConfig.MaxFileSize,
+		allowSymlinks: c.InRepoConfig.AllowSymlinks,
+		signingKey:    c.InRepoConfigSigningKey(identifier),
+		rejectEmpty:   c.InRepoConfigRejectEmptyFiles(identifier),
+		visit:         visit,
 	}
-	if err := validatePostsubmits(append(p.Postsubmits, c.PostsubmitsStatic[identifier]...), c.PodNamespace); err != nil {
+	if _, err := readProwYAML(logrus.WithField("repo", identifier), dir, opts); err != nil && err != ErrStopReadingProwYAML {
 		return err
 	}
+	return nil
+}
 
-	var errs []error
-	for _, pre := range p.Presubmits {
-		if !c.InRepoConfigAllowsCluster(pre.Cluster, identifier) {
-			errs = append(errs, fmt.Errorf("cluster %q is not allowed for repository %q", pre.Cluster, identifier))
+// prowYAMLFromFiles reads, defaults and validates the ProwYAML in files. If
+// that fails, the step that failed is returned as well. If treeSHA is set to
+// the SHA of the git tree of files, the read ProwYAML is cached for it. If
+// jobType is set, only jobs of that type are read.
+func prowYAMLFromFiles(log *logrus.Entry, c *Config, files prowYAMLFiles, identifier, treeSHA string, jobType prowapi.ProwJobType) (*ProwYAML, string, error) {
+	opts := prowYAMLReadOpts{
+		basePath:      c.InRepoConfigBasePath(identifier),
+		fileName:      c.InRepoConfigFileName(identifier),
+		strict:        c.InRepoConfigStrict(identifier),
+		maxFileSize:   c.InRepoConfig.MaxFileSize,
+		allowSymlinks: c.InRepoConfig.AllowSymlinks,
+		jobType:       jobType,
+		maxJobs:       c.InRepoConfigMaxJobs(identifier),
+		signingKey:    c.InRepoConfigSigningKey(identifier),
+		rejectEmpty:   c.InRepoConfigRejectEmptyFiles(identifier),
+	}
+	var prowYAML *ProwYAML
+	var err error
+	if treeSHA != "" && c.InRepoConfig.CacheSize > 0 {
+		key := fmt.Sprintf("%s:%s:%s:%t:%d:%t:%s:%d:%x:%t", treeSHA, opts.basePath, opts.fileName, opts.strict, opts.maxFileSize, opts.allowSymlinks, opts.jobType, opts.maxJobs, opts.signingKey, opts.rejectEmpty)
+		prowYAML, err = defaultProwYAMLCache.getOrRead(key, c.InRepoConfig.CacheSize, func() (*ProwYAML, error) {
+			return readProwYAMLFrom(log, files, opts)
+		})
+	} else {
+		prowYAML, err = readProwYAMLFrom(log, files, opts)
+	}
+	if err != nil {
+		return nil, "read", err
+	}
+	reason, err := defaultAndValidateReadProwYAML(c, prowYAML, identifier)
+	if err != nil {
+		return nil, reason, err
+	}
+	return prowYAML, "", nil
+}
+
+// defaultAndValidateReadProwYAML does everything that needs to happen to a
+// ProwYAML after it was read. If that fails, the step that failed is returned
+// as well.
+func defaultAndValidateReadProwYAML(c *Config, prowYAML *ProwYAML, identifier string) (string, error) {
+	if len(c.InRepoConfig.AllowedEnvVars) > 0 {
+		if err := expandEnvVars(prowYAML, c.InRepoConfig.AllowedEnvVars, os.LookupEnv); err != nil {
+			return "expand_env_vars", fmt.Errorf("failed to expand environment variables: %v", err)
 		}
 	}
-	for _, post := range p.Postsubmits {
-		if !c.InRepoConfigAllowsCluster(post.Cluster, identifier) {
-			errs = append(errs, fmt.Errorf("cluster %q is not allowed for repository %q", post.Cluster, identifier))
+
+	if c.InRepoConfig.Transform != nil {
+		transformed, err := c.InRepoConfig.Transform(prowYAML, identifier)
+		if err != nil {
+			return "transform", fmt.Errorf("failed to transform: %w", err)
 		}
+		if transformed == nil {
+			return "transform", errors.New("failed to transform: no ProwYAML was returned")
+		}
+		*prowYAML = *transformed
 	}
 
-	return utilerrors.NewAggregate(errs)
+	if err := DefaultAndValidateProwYAML(c, prowYAML, identifier); err != nil {
+		return "validate", err
+	}
+
+	return "", nil
+}
+
+// mergeAndCheckout merges the head SHAs into the base SHA with the merge method
+// of Tide. If that fails for another reason than a missing commit, the merge
+// retry methods of the repository are tried in order.
+func mergeAndCheckout(ctx context.Context, log *logrus.Entry, c *Config, repo git.RepoClient, identifier string, orgRepo OrgRepo, baseSHA string, headSHAs ...string) error {
+	methods := append([]github.PullRequestMergeType{c.Tide.MergeMethod(orgRepo)}, c.InRepoConfigMergeRetryMethods(identifier)...)
+	var err error
+	for attempt, method := range methods {
+		if attempt > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		attemptLog := log.WithFields(logrus.Fields{"merge-method": method, "merge-attempt": attempt + 1})
+		attemptLog.Debug("Merging head SHAs into base SHA.")
+		if err = repo.MergeAndCheckout(baseSHA, string(method), headSHAs...); err == nil {
+			return nil
+		}
+		attemptLog.WithError(err).Warn("Failed to merge head SHAs into base SHA.")
+		if sha := missingCommit(repo, append([]string{baseSHA}, headSHAs...)); sha != "" {
+			inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "sha_not_found").Inc()
+			return fmt.Errorf("failed to merge: %w: %s", ErrSHANotFound, sha)
+		}
+	}
+	inRepoConfigFailures.WithLabelValues(orgRepo.Org, orgRepo.Repo, "merge").Inc()
+	return fmt.Errorf("failed to merge: %w", err)
+}
+
+// shaRegex matches full and abbreviated SHA-1 and SHA-256 git object names.
+var shaRegex = regexp.MustCompile(`^[0-9a-fA-F]{4,64}$`)
+
+func validateSHA(sha string) error {
+	if sha == "" {
+		return errors.New("must not be empty")
+	}
+	if !shaRegex.MatchString(sha) {
+		return fmt.Errorf("%q is not a hexadecimal git object name", sha)
+	}
+	return nil
+}
+
+// clientForWithRetries gets a client for the repository from gc. Failures are
+// retried up to the given number of attempts in total, waiting retryDelay before
+// the first retry and doubling that for every further one. Timeouts and errors
+// that indicate that the repository doesn't exist are not retried.
+func clientForWithRetries(ctx context.Context, clk clock.Clock, log *logrus.Entry, gc git.ClientFactory, orgRepo OrgRepo, timeout time.Duration, attempts int, retryDelay time.Duration) (git.RepoClient, error) {
+	for attempt := 1; ; attempt++ {
+		repo, err := clientForWithTimeout(clk, log, gc, orgRepo, timeout)
+		if err == nil || attempt >= attempts || !isRetryableCloneError(err) {
+			return repo, err
+		}
+		log.WithError(err).Warnf("Failed to clone repo, retrying in %v.", retryDelay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-clk.After(retryDelay):
+		}
+		retryDelay *= 2
+	}
+}
+
+func isRetryableCloneError(err error) bool {
+	if errors.Is(err, errCloneTimedOut) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return !strings.Contains(msg, "not found") && !strings.Contains(msg, "does not exist")
+}
+
+// shallowClientFactory is a git.ClientFactory whose clients only have the last
+// depth commits of the history of the base and head SHAs. If getting such a
+// client fails, e.g. because the remote doesn't allow fetching a SHA, it falls
+// back to a complete clone, so the error is the same as without a depth.
+type shallowClientFactory struct {
+	git.ShallowClientFactory
+	log      *logrus.Entry
+	depth    int
+	baseSHA  string
+	headSHAs []string
+}
+
+func (s *shallowClientFactory) ClientFor(org, repo string) (git.RepoClient, error) {
+	client, err := s.ShallowClientFor(org, repo, s.depth, s.baseSHA, s.headSHAs...)
+	if err == nil {
+		return client, nil
+	}
+	s.log.WithError(err).Warn("Failed to fetch shallow history, cloning the complete history instead.")
+	return s.ShallowClientFactory.ClientFor(org, repo)
+}
+
+// errCloneTimedOut is returned by clientForWithTimeout when the timeout passed.
+var errCloneTimedOut = errors.New("timed out")
+
+// clientForWithTimeout gets a client for the repository from gc. If that doesn't
+// finish within the timeout, an error is returned and the client is cleaned up
+// once it is there. A timeout of zero means there is no timeout.
+func clientForWithTimeout(clk clock.Clock, log *logrus.Entry, gc git.ClientFactory, orgRepo OrgRepo, timeout time.Duration) (git.RepoClient, error) {
+	if timeout <= 0 {
+		return gc.ClientFor(orgRepo.Org, orgRepo.Repo)
+	}
+
+	type result struct {
+		repo git.RepoClient
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		repo, err := gc.ClientFor(orgRepo.Org, orgRepo.Repo)
+		results <- result{repo: repo, err: err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.repo, r.err
+	case <-clk.After(timeout):
+		go func() {
+			if r := <-results; r.err == nil {
+				if err := r.repo.Clean(); err != nil {
+					log.WithError(err).Error("Failed to clean up repo after clone timed out.")
+				}
+			}
+		}()
+		return nil, fmt.Errorf("%w after %v", errCloneTimedOut, timeout)
+	}
+}
+
+// ReadProwYAML parses the .prow.yaml or, if that doesn't exist, the .prow.json
+// file in the given directory. No checkout or defaulting is done. If strict is
+// true, unknown fields are rejected. If none of the files exist, an empty
+// ProwYAML is returned. If one exists but only contains whitespace or
+// comments, a warning is logged and an empty ProwYAML is returned as well.
+// The SourcePath of the ProwYAML and of each job is set to the path of the
+// file relative to dir, so it tells which of the files was read.
+func ReadProwYAML(log *logrus.Entry, dir string, strict bool) (*ProwYAML, error) {
+	return readProwYAML(log, dir, prowYAMLReadOpts{strict: strict})
+}
+
+// prowYAMLReadOpts controls how the in-repo config file is read.
+type prowYAMLReadOpts struct {
+	// basePath is the directory relative to dir in which the file is
+	// looked up.
+	basePath string
+	// fileName is the name of the file without extension. It defaults to
+	// DefaultInRepoConfigFileName.
+	fileName string
+	// strict makes unmarshalling reject unknown fields.
+	strict bool
+	// maxFileSize is the maximum size in bytes of the file. Zero means
+	// there is no limit.
+	maxFileSize int64
+	// allowSymlinks makes symlinks that point to a file inside of the
+	// directory get read. Otherwise, symlinks are ignored.
+	allowSymlinks bool
+	// jobType makes only jobs of that type get read if it is set.
+	jobType prowapi.ProwJobType
+	// maxJobs is the maximum number of presubmits and postsubmits, including
+	// those that aren't of jobType, the files may define. Zero means there is
+	// no limit.
+	maxJobs int
+	// signingKey makes files only get read if they have a valid detached
+	// signature made with the matching private key if it is set.
+	signingKey ed25519.PublicKey
+	// visit is called with the content of every file right after it was
+	// read if it is set. The jobs of included files are then not added to the
+	// including one.
+	visit func(fileName string, p *ProwYAML) error
+	// rejectEmpty makes files that only contain whitespace or comments get
+	// rejected. Otherwise, a warning is logged for them.
+	rejectEmpty bool
+}
+
+func readProwYAML(log *logrus.Entry, dir string, opts prowYAMLReadOpts) (*ProwYAML, error) {
+	return readProwYAMLFrom(log, dirFiles(dir), opts)
+}
+
+// prowYAMLFiles gives access to the files of a repository that its in-repo
+// config is read from. Names are slash-separated and relative to the root of
+// the repository.
+type prowYAMLFiles interface {
+	// lstat returns information about the file without following symlinks.
+	lstat(name string) (os.FileInfo, error)
+	// resolveSymlink returns the name of the file the symlink points to. An
+	// error is returned if that is outside of the repository.
+	resolveSymlink(name string) (string, error)
+	readFile(name string) ([]byte, error)
+}
+
+func readProwYAMLFrom(log *logrus.Entry, files prowYAMLFiles, opts prowYAMLReadOpts) (*ProwYAML, error) {
+	for _, fileName := range inRepoConfigPaths(opts.basePath, opts.fileName) {
+		info, err := files.lstat(fileName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Debugf("File %q does not exist.", fileName)
+				continue
+			}
+			return nil, fmt.Errorf("failed to check if file %q exists: %v", fileName, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 && !opts.allowSymlinks {
+			log.Debugf("Ignoring file %q because it is a symlink.", fileName)
+			continue
+		}
+
+		prowYAML, err := readProwYAMLFile(log, files, fileName, info, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		includes := &prowYAMLIncludes{names: sets.NewString(fileName)}
+		if err := readProwYAMLIncludes(log, files, prowYAML, []string{fileName}, includes, opts); err != nil {
+			return nil, err
+		}
+		// The maximum applies to all jobs, not only to those of jobType.
+		if numJobs := len(prowYAML.Presubmits) + len(prowYAML.Postsubmits); opts.maxJobs > 0 && numJobs > opts.maxJobs {
+			return nil, fmt.Errorf("file %q and the files it includes define %d jobs, which exceeds the maximum of %d", fileName, numJobs, opts.maxJobs)
+		}
+		switch opts.jobType {
+		case prowapi.PresubmitJob:
+			prowYAML.Postsubmits = nil
+		case prowapi.PostsubmitJob:
+			prowYAML.Presubmits = nil
+		}
+		prowYAML.SourcePath = fileName
+		log.Debugf("Read in-repo config from %q.", fileName)
+		return prowYAML, nil
+	}
+
+	return &ProwYAML{}, nil
+}
+
+// readProwYAMLFile reads and unmarshals the in-repo config file fileName,
+// whose lstat result is info, and sets the SourcePath of its jobs. If fileName
+// is included by another file, includes must be set and its size is added to
+// them.
+func readProwYAMLFile(log *logrus.Entry, files prowYAMLFiles, fileName string, info os.FileInfo, opts prowYAMLReadOpts, includes *prowYAMLIncludes) (*ProwYAML, error) {
+	readName := fileName
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !opts.allowSymlinks {
+			return nil, fmt.Errorf("file %q is a symlink", fileName)
+		}
+		var err error
+		if readName, err = files.resolveSymlink(fileName); err != nil {
+			return nil, fmt.Errorf("failed to resolve symlink %q: %v", fileName, err)
+		}
+		if info, err = files.lstat(readName); err != nil {
+			return nil, fmt.Errorf("failed to stat target of symlink %q: %v", fileName, err)
+		}
+	}
+	if opts.maxFileSize > 0 && info.Size() > opts.maxFileSize {
+		return nil, fmt.Errorf("file %q has a size of %d bytes, which exceeds the maximum of %d bytes", fileName, info.Size(), opts.maxFileSize)
+	}
+	if includes != nil {
+		if includes.size+info.Size() > maxInRepoConfigIncludedSize {
+			return nil, fmt.Errorf("file %q has a size of %d bytes, which makes the included files exceed the maximum total size of %d bytes", fileName, info.Size(), maxInRepoConfigIncludedSize)
+		}
+		includes.size += info.Size()
+	}
+
+	bytes, err := files.readFile(readName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", fileName, err)
+	}
+	if opts.signingKey != nil {
+		if err := verifyProwYAMLSignature(files, fileName, bytes, opts.signingKey); err != nil {
+			return nil, err
+		}
+	}
+	prowYAML := &ProwYAML{}
+	// Whitespace like tabs can't be unmarshalled, so empty files are not.
+	if isEmptyProwYAML(bytes) {
+		if opts.rejectEmpty {
+			return nil, fmt.Errorf("%w: %q only contains whitespace or comments", ErrEmptyProwYAML, fileName)
+		}
+		log.Warnf("File %q only contains whitespace or comments, so it doesn't define any jobs.", fileName)
+	} else if prowYAML, err = ReadProwYAMLFromBytes(log, bytes, opts.strict); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %q: %v", fileName, err)
+	}
+	for i := range prowYAML.Presubmits {
+		prowYAML.Presubmits[i].SourcePath = fileName
+	}
+	for i := range prowYAML.Postsubmits {
+		prowYAML.Postsubmits[i].SourcePath = fileName
+	}
+	prowYAML.Files = []string{fileName}
+	if readName != fileName {
+		prowYAML.Files = append(prowYAML.Files, readName)
+	}
+	if opts.signingKey != nil {
+		prowYAML.Files = append(prowYAML.Files, fileName+signatureFileSuffix)
+	}
+	if opts.visit != nil {
+		if err := opts.visit(fileName, prowYAML); err != nil {
+			return nil, err
+		}
+	}
+	return prowYAML, nil
+}
+
+// verifyProwYAMLSignature verifies the detached signature of the in-repo
+// config file fileName, whose content is data, with key.
+func verifyProwYAMLSignature(files prowYAMLFiles, fileName string, data []byte, key ed25519.PublicKey) error {
+	signatureName := fileName + signatureFileSuffix
+	info, err := files.lstat(signatureName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file %q is not signed: %q does not exist", fileName, signatureName)
+		}
+		return fmt.Errorf("failed to check if file %q exists: %v", signatureName, err)
+	}
+	if !info.Mode().IsRegular() || info.Size() > maxSignatureFileSize {
+		return fmt.Errorf("file %q must be a regular file of at most %d bytes", signatureName, maxSignatureFileSize)
+	}
+	encoded, err := files.readFile(signatureName)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %v", signatureName, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("failed to decode %q: %v", signatureName, err)
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("signature in %q is not valid for %q", signatureName, fileName)
+	}
+	return nil
+}
+
+const (
+	// maxInRepoConfigIncludedFiles is the maximum number of files an in-repo
+	// config file may include, directly or through other included files.
+	maxInRepoConfigIncludedFiles = 100
+	// maxInRepoConfigIncludedSize is the maximum total size in bytes of the
+	// files an in-repo config file includes.
+	maxInRepoConfigIncludedSize = 2 * DefaultInRepoConfigMaxFileSize
+)
+
+// prowYAMLIncludes are the files that were read for the includes of an
+// in-repo config file.
+type prowYAMLIncludes struct {
+	// names are the names of the included files and of the including one.
+	names sets.String
+	// size is the total size in bytes of the included files.
+	size int64
+}
+
+// readProwYAMLIncludes reads the files that p, which was read from the last
+// file of chain, includes and adds their templates and jobs to p. Includes
+// are resolved relative to the directory of the including file and must not
+// leave the repository. A file that is included more than once is only read
+// the first time, a file that includes itself through chain is rejected. At
+// most maxInRepoConfigIncludedFiles files with a total size of
+// maxInRepoConfigIncludedSize bytes are read.
+func readProwYAMLIncludes(log *logrus.Entry, files prowYAMLFiles, p *ProwYAML, chain []string, includes *prowYAMLIncludes, opts prowYAMLReadOpts) error {
+	fileName := chain[len(chain)-1]
+	for _, include := range p.Include {
+		name, err := cleanRepoPath(path.Join(path.Dir(fileName), include))
+		if err != nil || path.IsAbs(include) {
+			return fmt.Errorf("file %q includes %q, which is outside of the repository", fileName, include)
+		}
+		for _, including := range chain {
+			if including == name {
+				return fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), name)
+			}
+		}
+		if includes.names.Has(name) {
+			log.Debugf("Skipping %q included by %q because it was already included.", name, fileName)
+			continue
+		}
+		// The names also contain the file that includes all others.
+		if includes.names.Len() > maxInRepoConfigIncludedFiles {
+			return fmt.Errorf("file %q includes %q, which exceeds the maximum of %d included files", fileName, name, maxInRepoConfigIncludedFiles)
+		}
+		includes.names.Insert(name)
+
+		info, err := files.lstat(name)
+		if err != nil {
+			return fmt.Errorf("failed to stat %q included by %q: %v", name, fileName, err)
+		}
+		includedProwYAML, err := readProwYAMLFile(log, files, name, info, opts, includes)
+		if err != nil {
+			return err
+		}
+		if includedProwYAML.DecorationConfig != nil {
+			return fmt.Errorf("file %q included by %q sets decoration_config, which is only allowed in the file that includes the others", name, fileName)
+		}
+		if err := readProwYAMLIncludes(log, files, includedProwYAML, append(chain[:len(chain):len(chain)], name), includes, opts); err != nil {
+			return err
+		}
+		log.Debugf("Read %q included by %q.", name, fileName)
+		if opts.visit != nil {
+			continue
+		}
+		p.Templates = append(p.Templates, includedProwYAML.Templates...)
+		p.Presubmits = append(p.Presubmits, includedProwYAML.Presubmits...)
+		p.Postsubmits = append(p.Postsubmits, includedProwYAML.Postsubmits...)
+		p.Files = append(p.Files, includedProwYAML.Files...)
+	}
+	return nil
+}
+
+// cleanRepoPath cleans the slash-separated path name, which is relative to
+// the root of a repository. An error is returned if it is absolute or leaves
+// the repository.
+func cleanRepoPath(name string) (string, error) {
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("path %q is outside of the repository", name)
+	}
+	return cleaned, nil
+}
+
+// dirFiles are the files in a directory of the local filesystem.
+type dirFiles string
+
+// path returns the path of the file name in d. An error is returned if name
+// or a symlink in one of its parent directories leads outside of d.
+func (d dirFiles) path(name string) (string, error) {
+	cleaned, err := cleanRepoPath(name)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(string(d), filepath.FromSlash(cleaned))
+	if _, err := resolveSymlinkInDir(string(d), filepath.Dir(p)); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to resolve directory of %q: %v", name, err)
+	}
+	return p, nil
+}
+
+func (d dirFiles) lstat(name string) (os.FileInfo, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (d dirFiles) resolveSymlink(name string) (string, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return "", err
+	}
+	return resolveSymlinkInDir(string(d), p)
+}
+
+func (d dirFiles) readFile(name string) ([]byte, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+// ReadProwYAMLFromBytes unmarshals the content of a .prow.yaml or .prow.json
+// file. If strict is true, unknown fields are rejected. No defaulting is done.
+func ReadProwYAMLFromBytes(log *logrus.Entry, data []byte, strict bool) (*ProwYAML, error) {
+	var opts []yaml.JSONOpt
+	if strict {
+		opts = append(opts, yaml.DisallowUnknownFields)
+	}
+
+	prowYAML := &ProwYAML{}
+	if err := yaml.Unmarshal(data, prowYAML, opts...); err != nil {
+		return nil, withYAMLPosition(data, err, opts)
+	}
+	log.Debugf("Unmarshalled %d presubmits and %d postsubmits.", len(prowYAML.Presubmits), len(prowYAML.Postsubmits))
+	return prowYAML, nil
+}
+
+// ErrEmptyProwYAML is returned when reading an in-repo config file that exists
+// but only contains whitespace or comments, if such files are rejected.
+var ErrEmptyProwYAML = errors.New("in-repo config file is empty")
+
+// isEmptyProwYAML returns whether data, the content of an in-repo config file,
+// only contains whitespace, comments or an explicit null document, so it
+// unmarshals to an empty ProwYAML. Data that can't be parsed is not empty, so
+// unmarshalling reports the error.
+func isEmptyProwYAML(data []byte) bool {
+	if strings.TrimSpace(string(data)) == "" {
+		return true
+	}
+	var root yaml3.Node
+	if err := yaml3.Unmarshal(data, &root); err != nil {
+		return false
+	}
+	if root.Kind == 0 {
+		return true
+	}
+	return root.Kind == yaml3.DocumentNode && len(root.Content) == 1 && root.Content[0].Kind == yaml3.ScalarNode && root.Content[0].Tag == "!!null"
+}
+
+// withYAMLPosition prefixes err, the error of unmarshalling data into a
+// ProwYAML, with the line and column of the key or list item that caused it.
+// The errors of the JSON decoder that is used for unmarshalling don't contain
+// a position, so it is found by decoding the nodes of data one by one until
+// the innermost one that fails is found. Syntax errors already contain the
+// line and are returned as-is, just like errors whose position isn't found.
+func withYAMLPosition(data []byte, err error, opts []yaml.JSONOpt) error {
+	var root yaml3.Node
+	if yaml3.Unmarshal(data, &root) != nil || root.Kind != yaml3.DocumentNode || len(root.Content) != 1 {
+		return err
+	}
+	node := locateYAMLError(root.Content[0], reflect.TypeOf(ProwYAML{}), opts)
+	if node == nil {
+		return err
+	}
+	return fmt.Errorf("line %d, column %d: %w", node.Line, node.Column, err)
+}
+
+// locateYAMLError returns the innermost node of node that can't be unmarshalled
+// into a value of type t, or nil if there is none.
+func locateYAMLError(node *yaml3.Node, t reflect.Type, opts []yaml.JSONOpt) *yaml3.Node {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml3.MappingNode && (t.Kind() == reflect.Struct || t.Kind() == reflect.Map):
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			pair := &yaml3.Node{Kind: yaml3.MappingNode, Content: []*yaml3.Node{key, value}}
+			if decodesYAMLNode(pair, t, opts) {
+				continue
+			}
+			valueType, known := t, t.Kind() == reflect.Map
+			if known {
+				valueType = t.Elem()
+			} else {
+				valueType, known = jsonFieldType(t, key.Value)
+			}
+			if !known {
+				return key
+			}
+			if inner := locateYAMLError(value, valueType, opts); inner != nil {
+				return inner
+			}
+			return value
+		}
+	case node.Kind == yaml3.SequenceNode && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array):
+		for _, item := range node.Content {
+			if decodesYAMLNode(&yaml3.Node{Kind: yaml3.SequenceNode, Content: []*yaml3.Node{item}}, reflect.SliceOf(t.Elem()), opts) {
+				continue
+			}
+			if inner := locateYAMLError(item, t.Elem(), opts); inner != nil {
+				return inner
+			}
+			return item
+		}
+	}
+	return nil
+}
+
+// decodesYAMLNode returns whether node can be unmarshalled into a value of
+// type t. Nodes that can't be marshalled, e.g. because they reference an
+// anchor outside of them, are treated as if they could.
+func decodesYAMLNode(node *yaml3.Node, t reflect.Type, opts []yaml.JSONOpt) bool {
+	data, err := yaml3.Marshal(node)
+	if err != nil {
+		return true
+	}
+	return yaml.Unmarshal(data, reflect.New(t).Interface(), opts...) == nil
+}
+
+// jsonFieldType returns the type of the field of the struct type t that is
+// serialized with the given name, including the fields of embedded structs.
+func jsonFieldType(t reflect.Type, name string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" && len(tag) == 1 {
+			continue
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && tag[0] == "" && fieldType.Kind() == reflect.Struct {
+			if inner, ok := jsonFieldType(fieldType, name); ok {
+				return inner, true
+			}
+			continue
+		}
+		fieldName := tag[0]
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		if strings.EqualFold(fieldName, name) {
+			return field.Type, true
+		}
+	}
+	return nil, false
+}
+
+// ProwYAMLValidationResult is the result of defaulting and validating an
+// in-repo config.
+type ProwYAMLValidationResult struct {
+	// Errors are the problems that make the in-repo config invalid.
+	Errors []error
+	// Warnings are the problems that should be reported, but don't make the
+	// in-repo config invalid, e.g. a preset label that matches no preset or a
+	// job that has the name of a static job.
+	Warnings []error
+}
+
+// Err returns the errors and warnings of r combined into one error, or nil if
+// there are none.
+func (r ProwYAMLValidationResult) Err() error {
+	var errs []error
+	errs = append(errs, r.Errors...)
+	errs = append(errs, r.Warnings...)
+	return utilerrors.NewAggregate(errs)
+}
+
+// DefaultAndValidateProwYAML defaults the jobs of p for the repository
+// identified by identifier and validates them. It returns the error of the
+// first check that fails combined with the warnings found until then. It
+// modifies p: the base jobs are added, templates are expanded and the jobs
+// are defaulted, which sets p.Defaulted if it succeeds. If p.Defaulted is
+// already set, p is only validated and not modified, so calling it again is
+// safe.
+func DefaultAndValidateProwYAML(c *Config, p *ProwYAML, identifier string) error {
+	return DefaultAndValidateProwYAMLWithWarnings(c, p, identifier).Err()
+}
+
+// DefaultAndValidateProwYAMLWithWarnings is like DefaultAndValidateProwYAML,
+// but returns the errors and warnings separately, so callers can only report
+// the warnings. The checks stop at the first error, but not at warnings.
+func DefaultAndValidateProwYAMLWithWarnings(c *Config, p *ProwYAML, identifier string) ProwYAMLValidationResult {
+	return defaultAndValidateProwYAML(c, p, identifier, false)
+}
+
+// ValidateProwYAMLAll defaults and validates a copy of p like
+// DefaultAndValidateProwYAML, so p is not modified, but doesn't stop at the
+// first check that fails.
+// It returns the errors of all checks, so all problems can be reported at
+// once. Only the checks that need the jobs to be defaulted successfully are
+// skipped if they aren't.
+func ValidateProwYAMLAll(c *Config, p *ProwYAML, identifier string) []error {
+	p, err := copyProwYAML(p)
+	if err != nil {
+		return []error{fmt.Errorf("failed to copy the in-repo config: %v", err)}
+	}
+	result := defaultAndValidateProwYAML(c, p, identifier, true)
+	return append(result.Errors, result.Warnings...)
+}
+
+// defaultAndValidateProwYAML implements DefaultAndValidateProwYAML and
+// ValidateProwYAMLAll. Unless all is set, only the error of the first check
+// that fails is returned.
+func defaultAndValidateProwYAML(c *Config, p *ProwYAML, identifier string, all bool) ProwYAMLValidationResult {
+	var errs, warnings []error
+	// failed records err and returns whether no further checks should run.
+	failed := func(err error) bool {
+		if err == nil {
+			return false
+		}
+		if !all {
+			errs = append(errs, err)
+			return true
+		}
+		if aggregate, ok := err.(utilerrors.Aggregate); ok {
+			errs = append(errs, aggregate.Errors()...)
+		} else {
+			errs = append(errs, err)
+		}
+		return false
+	}
+	// warned records the warnings in err, which never stop the checks.
+	warned := func(err error) {
+		if aggregate, ok := err.(utilerrors.Aggregate); ok {
+			warnings = append(warnings, aggregate.Errors()...)
+		} else if err != nil {
+			warnings = append(warnings, err)
+		}
+	}
+	result := func() ProwYAMLValidationResult {
+		return ProwYAMLValidationResult{Errors: errs, Warnings: warnings}
+	}
+
+	// An already defaulted ProwYAML is only validated again, as defaulting it
+	// again would e.g. add the base jobs and apply the presets twice. The
+	// checks of the file itself, like the maximum number of jobs, were done
+	// when it was defaulted.
+	var presubmitsErr, postsubmitsErr error
+	if !p.Defaulted {
+		if maxJobs := c.InRepoConfigMaxJobs(identifier); maxJobs > 0 {
+			if numJobs := len(p.Presubmits) + len(p.Postsubmits); numJobs > maxJobs {
+				if failed(fmt.Errorf("repository %q defines %d jobs, which exceeds the maximum of %d", identifier, numJobs, maxJobs)) {
+					return result()
+				}
+			}
+		}
+		if failed(validateInRepoConfigDecorationDefault(p.DecorationConfig)) {
+			return result()
+		}
+		// The base jobs are appended to those of the repository, which are the
+		// only ones its default decoration config applies to.
+		numPresubmits, numPostsubmits := len(p.Presubmits), len(p.Postsubmits)
+		if failed(mergeBaseProwYAML(c.InRepoConfig.Base, p)) {
+			return result()
+		}
+		if failed(expandJobTemplates(p)) {
+			return result()
+		}
+		if p.DecorationConfig != nil {
+			for i := range p.Presubmits[:numPresubmits] {
+				if ShouldDecorate(&c.JobConfig, p.Presubmits[i].UtilityConfig) {
+					p.Presubmits[i].DecorationConfig = p.Presubmits[i].DecorationConfig.ApplyDefault(p.DecorationConfig)
+				}
+			}
+			for i := range p.Postsubmits[:numPostsubmits] {
+				if ShouldDecorate(&c.JobConfig, p.Postsubmits[i].UtilityConfig) {
+					p.Postsubmits[i].DecorationConfig = p.Postsubmits[i].DecorationConfig.ApplyDefault(p.DecorationConfig)
+				}
+			}
+		}
+		// Jobs whose branch regexes don't compile can't be defaulted, so there is
+		// nothing left to check.
+		if err := validateInRepoConfigBranches(p); err != nil {
+			failed(err)
+			return result()
+		}
+		// Jobs that could not be defaulted are not validated, as that may panic
+		// if their regexes are not set.
+		presubmitsErr = defaultPresubmits(p.Presubmits, c, identifier)
+		if failed(presubmitsErr) {
+			return result()
+		}
+		postsubmitsErr = defaultPostsubmits(p.Postsubmits, c, identifier)
+		if failed(postsubmitsErr) {
+			return result()
+		}
+		p.Defaulted = len(errs) == 0
+	}
+	// Jobs with the names of static jobs shadow them, which is only a
+	// warning, so the shadowed static jobs aren't validated with them.
+	warned(validateNoStaticJobNameCollisions(c, p, identifier))
+	if presubmitsErr == nil && failed(validatePresubmits(append(p.Presubmits, unshadowedStaticPresubmits(c, p, identifier)...), c.PodNamespace)) {
+		return result()
+	}
+	if postsubmitsErr == nil && failed(validatePostsubmits(append(p.Postsubmits, unshadowedStaticPostsubmits(c, p, identifier)...), c.PodNamespace)) {
+		return result()
+	}
+
+	var jobErrs []error
+	for _, pre := range p.Presubmits {
+		if err := validateInRepoConfigCluster(c, pre.Cluster, identifier); err != nil {
+			jobErrs = append(jobErrs, err)
+		}
+		if err := validateInRepoConfigDecoration(c, pre.JobBase); err != nil {
+			jobErrs = append(jobErrs, err)
+		}
+		if !c.InRepoConfigAllowsAgent(pre.Agent, identifier) {
+			jobErrs = append(jobErrs, fmt.Errorf("job %q uses agent %q, which is not allowed for repository %q", pre.Name, pre.Agent, identifier))
+		}
+		warnings = append(warnings, validateInRepoConfigPresets(c, pre.JobBase)...)
+		jobErrs = append(jobErrs, validateInRepoConfigPodSecurity(c, pre.JobBase, identifier)...)
+	}
+	for _, post := range p.Postsubmits {
+		if err := validateInRepoConfigCluster(c, post.Cluster, identifier); err != nil {
+			jobErrs = append(jobErrs, err)
+		}
+		if err := validateInRepoConfigDecoration(c, post.JobBase); err != nil {
+			jobErrs = append(jobErrs, err)
+		}
+		if !c.InRepoConfigAllowsAgent(post.Agent, identifier) {
+			jobErrs = append(jobErrs, fmt.Errorf("job %q uses agent %q, which is not allowed for repository %q", post.Name, post.Agent, identifier))
+		}
+		warnings = append(warnings, validateInRepoConfigPresets(c, post.JobBase)...)
+		jobErrs = append(jobErrs, validateInRepoConfigPodSecurity(c, post.JobBase, identifier)...)
+	}
+	failed(utilerrors.NewAggregate(jobErrs))
+
+	return result()
+}
+
+// validateInRepoConfigBranches makes sure that the branches and skip_branches
+// of all jobs in p are valid regexes, so every job only runs for the branches
+// it is meant for.
+func validateInRepoConfigBranches(p *ProwYAML) error {
+	var errs []error
+	validate := func(jobName string, brancher Brancher) {
+		for _, field := range []struct {
+			name    string
+			regexes []string
+		}{
+			{name: "branches", regexes: brancher.Branches},
+			{name: "skip_branches", regexes: brancher.SkipBranches},
+		} {
+			for _, branch := range field.regexes {
+				if _, err := regexp.Compile(branch); err != nil {
+					errs = append(errs, fmt.Errorf("job %q has an invalid regex %q in %s: %v", jobName, branch, field.name, err))
+				}
+			}
+		}
+	}
+	for _, pre := range p.Presubmits {
+		validate(pre.Name, pre.Brancher)
+	}
+	for _, post := range p.Postsubmits {
+		validate(post.Name, post.Brancher)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// validateInRepoConfigPodSecurity returns an error for every security-sensitive
+// setting of the pod spec of job that the pod security policy of the repository
+// doesn't allow.
+func validateInRepoConfigPodSecurity(c *Config, job JobBase, identifier string) []error {
+	policy := c.InRepoConfigPodSecurityPolicy(identifier)
+	if policy == nil || job.Spec == nil {
+		return nil
+	}
+	var errs []error
+	disallowed := func(field string) {
+		errs = append(errs, fmt.Errorf("job %q sets %s, which is not allowed for repository %q", job.Name, field, identifier))
+	}
+	if job.Spec.HostNetwork && !policy.AllowHostNetwork {
+		disallowed("spec.hostNetwork")
+	}
+	if job.Spec.HostPID && !policy.AllowHostPID {
+		disallowed("spec.hostPID")
+	}
+	if !policy.AllowHostPathVolumes {
+		for i, volume := range job.Spec.Volumes {
+			if volume.HostPath != nil {
+				disallowed(fmt.Sprintf("spec.volumes[%d].hostPath", i))
+			}
+		}
+	}
+	if !policy.AllowPrivileged {
+		privileged := func(field string, containers []v1.Container) {
+			for i, container := range containers {
+				if container.SecurityContext != nil && container.SecurityContext.Privileged != nil && *container.SecurityContext.Privileged {
+					disallowed(fmt.Sprintf("spec.%s[%d].securityContext.privileged", field, i))
+				}
+			}
+		}
+		privileged("initContainers", job.Spec.InitContainers)
+		privileged("containers", job.Spec.Containers)
+	}
+	return errs
+}
+
+// validateNoStaticJobNameCollisions makes sure that no job in p has the name
+// of a static job of the same type for the same repository.
+func validateNoStaticJobNameCollisions(c *Config, p *ProwYAML, identifier string) error {
+	staticPresubmits := sets.NewString()
+	for _, ps := range c.PresubmitsStatic[identifier] {
+		staticPresubmits.Insert(ps.Name)
+	}
+	staticPostsubmits := sets.NewString()
+	for _, ps := range c.PostsubmitsStatic[identifier] {
+		staticPostsubmits.Insert(ps.Name)
+	}
+
+	collidingPresubmits := sets.NewString()
+	for _, ps := range p.Presubmits {
+		if staticPresubmits.Has(ps.Name) {
+			collidingPresubmits.Insert(ps.Name)
+		}
+	}
+	collidingPostsubmits := sets.NewString()
+	for _, ps := range p.Postsubmits {
+		if staticPostsubmits.Has(ps.Name) {
+			collidingPostsubmits.Insert(ps.Name)
+		}
+	}
+
+	var errs []error
+	if collidingPresubmits.Len() > 0 {
+		errs = append(errs, fmt.Errorf("presubmits %s are already defined in the central config for repository %q", strings.Join(collidingPresubmits.List(), ", "), identifier))
+	}
+	if collidingPostsubmits.Len() > 0 {
+		errs = append(errs, fmt.Errorf("postsubmits %s are already defined in the central config for repository %q", strings.Join(collidingPostsubmits.List(), ", "), identifier))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// unshadowedStaticPresubmits returns the static presubmits of the repository
+// identified by identifier that have a different name than all presubmits of p.
+func unshadowedStaticPresubmits(c *Config, p *ProwYAML, identifier string) []Presubmit {
+	names := sets.NewString()
+	for _, ps := range p.Presubmits {
+		names.Insert(ps.Name)
+	}
+	var presubmits []Presubmit
+	for _, ps := range c.PresubmitsStatic[identifier] {
+		if !names.Has(ps.Name) {
+			presubmits = append(presubmits, ps)
+		}
+	}
+	return presubmits
+}
+
+// unshadowedStaticPostsubmits returns the static postsubmits of the repository
+// identified by identifier that have a different name than all postsubmits of
+// p.
+func unshadowedStaticPostsubmits(c *Config, p *ProwYAML, identifier string) []Postsubmit {
+	names := sets.NewString()
+	for _, ps := range p.Postsubmits {
+		names.Insert(ps.Name)
+	}
+	var postsubmits []Postsubmit
+	for _, ps := range c.PostsubmitsStatic[identifier] {
+		if !names.Has(ps.Name) {
+			postsubmits = append(postsubmits, ps)
+		}
+	}
+	return postsubmits
+}
+
+// validateInRepoConfigDecoration makes sure a decorated job got a decoration
+// config. For static jobs, finalizeJobConfig already requires the global
+// default decoration config to exist if any job is decorated, but that can
+// not take jobs from in-repo config into account.
+func validateInRepoConfigDecoration(c *Config, job JobBase) error {
+	if ShouldDecorate(&c.JobConfig, job.UtilityConfig) && job.DecorationConfig == nil {
+		return fmt.Errorf("job %q is decorated, but neither it nor plank.default_decoration_configs specify a decoration config", job.Name)
+	}
+	return nil
+}
+
+// presetLabelPrefix is the prefix of labels that are used to select presets
+// by convention.
+const presetLabelPrefix = "preset-"
+
+// validateInRepoConfigPresets makes sure every preset label of job matches at
+// least one preset. Jobs can not define presets in the in-repo config, so a
+// typo in a preset label would otherwise silently leave the job without the
+// environment variables and volumes it expects.
+func validateInRepoConfigPresets(c *Config, job JobBase) []error {
+	var keys []string
+	for key := range job.Labels {
+		if strings.HasPrefix(key, presetLabelPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		value := job.Labels[key]
+		matched := false
+		for _, preset := range c.Presets {
+			if presetValue, ok := preset.Labels[key]; ok && presetValue == value {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = append(errs, fmt.Errorf("job %q has the label %s=%s, which matches no preset", job.Name, key, value))
+		}
+	}
+	return errs
+}
+
+func validateInRepoConfigCluster(c *Config, clusterName, identifier string) error {
+	if !c.inRepoConfigKnowsCluster(clusterName) {
+		return fmt.Errorf("cluster %q is not defined", clusterName)
+	}
+	if !c.InRepoConfigAllowsCluster(clusterName, identifier) {
+		return fmt.Errorf("cluster %q is not allowed for repository %q", clusterName, identifier)
+	}
+	return nil
+}
+
+// mergeBaseProwYAML adds a copy of the templates and jobs of base to p, unless
+// p already has a template or job of the same type with the same name.
+func mergeBaseProwYAML(base, p *ProwYAML) error {
+	if base == nil {
+		return nil
+	}
+	base, err := copyProwYAML(base)
+	if err != nil {
+		return fmt.Errorf("failed to copy the base in-repo config: %v", err)
+	}
+
+	templates := sets.NewString()
+	for _, t := range p.Templates {
+		templates.Insert(t.Name)
+	}
+	for _, t := range base.Templates {
+		if !templates.Has(t.Name) {
+			p.Templates = append(p.Templates, t)
+		}
+	}
+	presubmits := sets.NewString()
+	for _, ps := range p.Presubmits {
+		presubmits.Insert(ps.Name)
+	}
+	for _, ps := range base.Presubmits {
+		if !presubmits.Has(ps.Name) {
+			p.Presubmits = append(p.Presubmits, ps)
+		}
+	}
+	postsubmits := sets.NewString()
+	for _, ps := range p.Postsubmits {
+		postsubmits.Insert(ps.Name)
+	}
+	for _, ps := range base.Postsubmits {
+		if !postsubmits.Has(ps.Name) {
+			p.Postsubmits = append(p.Postsubmits, ps)
+		}
+	}
+	return nil
+}
+
+// validateInRepoConfigDecorationDefault validates the parts of the default
+// decoration config of an in-repo config that don't depend on the decoration
+// configs it is merged with. The merged decoration config of every decorated
+// job is validated completely.
+func validateInRepoConfigDecorationDefault(d *prowapi.DecorationConfig) error {
+	if d == nil {
+		return nil
+	}
+	if d.OauthTokenSecret != nil && len(d.SSHKeySecrets) > 0 {
+		return errors.New("decoration_config: both OAuth token and SSH key secrets are specified")
+	}
+	if d.Timeout.Get() < 0 {
+		return fmt.Errorf("decoration_config: timeout %v must not be negative", d.Timeout.Get())
+	}
+	if d.GracePeriod.Get() < 0 {
+		return fmt.Errorf("decoration_config: grace period %v must not be negative", d.GracePeriod.Get())
+	}
+	return nil
+}
+
+// expandJobTemplates sets all fields of the Presubmits and Postsubmits of p
+// that reference a template and are not set on the job itself to the values
+// of that template.
+func expandJobTemplates(p *ProwYAML) error {
+	templates := make(map[string]JobBase, len(p.Templates))
+	var errs []error
+	for _, template := range p.Templates {
+		switch {
+		case template.Name == "":
+			errs = append(errs, errors.New("templates must have a name"))
+		case template.Template != "":
+			errs = append(errs, fmt.Errorf("template %q must not reference another template", template.Name))
+		default:
+			if _, exists := templates[template.Name]; exists {
+				errs = append(errs, fmt.Errorf("template %q is defined more than once", template.Name))
+			}
+			templates[template.Name] = template.JobBase
+		}
+	}
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	expand := func(job *JobBase) error {
+		if job.Template == "" {
+			return nil
+		}
+		template, ok := templates[job.Template]
+		if !ok {
+			return fmt.Errorf("job %q references template %q, which does not exist", job.Name, job.Template)
+		}
+		return applyJobTemplate(job, template)
+	}
+	for i := range p.Presubmits {
+		if err := expand(&p.Presubmits[i].JobBase); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i := range p.Postsubmits {
+		if err := expand(&p.Postsubmits[i].JobBase); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// applyJobTemplate sets all fields of job that have their zero value to the
+// value of the same field of a copy of template. The fields of the embedded
+// UtilityConfig are handled one by one, all other fields are replaced as a whole.
+func applyJobTemplate(job *JobBase, template JobBase) error {
+	// Round-trip the template so jobs based on the same template don't share
+	// any maps, slices or pointers.
+	raw, err := yaml.Marshal(template)
+	if err != nil {
+		return fmt.Errorf("failed to marshal template %q: %v", template.Name, err)
+	}
+	var templateCopy JobBase
+	if err := yaml.Unmarshal(raw, &templateCopy); err != nil {
+		return fmt.Errorf("failed to unmarshal template %q: %v", template.Name, err)
+	}
+	templateCopy.Name = job.Name
+	templateCopy.Template = job.Template
+	templateCopy.SourcePath = job.SourcePath
+
+	fillZeroFields(reflect.ValueOf(job).Elem(), reflect.ValueOf(templateCopy))
+	return nil
+}
+
+func fillZeroFields(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fillZeroFields(dst.Field(i), src.Field(i))
+			continue
+		}
+		if dst.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// resolveSymlinkInDir resolves the symlink at the given path and returns the
+// slash-separated path of its target relative to dir, or an error if the target
+// is not inside of dir.
+func resolveSymlinkInDir(dir, path string) (string, error) {
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	relPath, err := filepath.Rel(resolvedDir, resolvedPath)
+	if err != nil {
+		return "", err
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("target %q is outside of the repository", resolvedPath)
+	}
+	return filepath.ToSlash(relPath), nil
+}
+
+var envVarReferenceRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvVars replaces ${NAME} references in all string values of the ProwYAML
+// with the value lookup returns for NAME, if NAME is in allowed. References to
+// variables that are not allowed are left as they are. An error is returned for
+// allowed variables that are not set.
+func expandEnvVars(p *ProwYAML, allowed []string, lookup func(string) (string, bool)) error {
+	allowedVars := sets.NewString(allowed...)
+	unsetVars := sets.NewString()
+	expand := func(s string) string {
+		return envVarReferenceRegex.ReplaceAllStringFunc(s, func(reference string) string {
+			name := envVarReferenceRegex.FindStringSubmatch(reference)[1]
+			if !allowedVars.Has(name) {
+				return reference
+			}
+			value, ok := lookup(name)
+			if !ok {
+				unsetVars.Insert(name)
+				return reference
+			}
+			return value
+		})
+	}
+	// The includes were already read and the ignored part and the metadata
+	// aren't used for jobs, so only the jobs and their defaults are expanded.
+	for _, v := range []interface{}{&p.Templates, &p.Presubmits, &p.Postsubmits, &p.DecorationConfig} {
+		expandStrings(reflect.ValueOf(v).Elem(), expand)
+	}
+
+	if unsetVars.Len() > 0 {
+		return fmt.Errorf("referenced environment variables are not set: %s", strings.Join(unsetVars.List(), ", "))
+	}
+	return nil
+}
+
+// expandStrings calls expand on all exported string values reachable from v
+// and sets them to its result.
+func expandStrings(v reflect.Value, expand func(string) string) {
+	switch v.Kind() {
+	case reflect.String:
+		if expanded := expand(v.String()); expanded != v.String() && v.CanSet() {
+			v.SetString(expanded)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandStrings(v.Elem(), expand)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				// Unexported
+				continue
+			}
+			if v.Type().Field(i).Tag.Get("json") == "-" {
+				// Not read from the file, e.g. the SourcePath of jobs
+				continue
+			}
+			expandStrings(v.Field(i), expand)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandStrings(v.Index(i), expand)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			expandStrings(value, expand)
+			v.SetMapIndex(key, value)
+		}
+	}
 }
@@ -0,0 +1,179 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inRepoConfigCacheLookups counts the lookups in the cache of read in-repo
+// config files by whether they were a hit or a miss.
+var inRepoConfigCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "inrepoconfig_cache_lookups",
+	Help: "Number of lookups in the cache of read in-repo config files by result (hit or miss).",
+}, []string{"result"})
+
+// inRepoConfigNegativeCacheLookups counts the lookups in the cache of
+// repositories known to have no in-repo config by whether they were a hit
+// or a miss.
+var inRepoConfigNegativeCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "inrepoconfig_negative_cache_lookups",
+	Help: "Number of lookups in the cache of repositories without in-repo config by result (hit or miss).",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(inRepoConfigCacheLookups)
+	prometheus.MustRegister(inRepoConfigNegativeCacheLookups)
+}
+
+// defaultProwYAMLCache is the cache used by the default ProwYAMLGetter.
+var defaultProwYAMLCache = &prowYAMLCache{}
+
+// prowYAMLCache keeps read, but not yet defaulted ProwYAMLs by a key that
+// identifies the content they were read from. Once it is full, the oldest
+// entry is evicted.
+type prowYAMLCache struct {
+	lock    sync.Mutex
+	entries map[string]*ProwYAML
+	keys    []string
+}
+
+// getOrRead returns a copy of the ProwYAML cached for key. If there is none,
+// it calls read and caches a copy of its result, unless that is an error.
+// At most maxEntries are kept.
+func (c *prowYAMLCache) getOrRead(key string, maxEntries int, read func() (*ProwYAML, error)) (*ProwYAML, error) {
+	c.lock.Lock()
+	cached, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok {
+		inRepoConfigCacheLookups.WithLabelValues("hit").Inc()
+		return copyProwYAML(cached)
+	}
+	inRepoConfigCacheLookups.WithLabelValues("miss").Inc()
+
+	prowYAML, err := read()
+	if err != nil {
+		return nil, err
+	}
+	toCache, err := copyProwYAML(prowYAML)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]*ProwYAML{}
+	}
+	if _, exists := c.entries[key]; !exists {
+		c.keys = append(c.keys, key)
+	}
+	c.entries[key] = toCache
+	for len(c.keys) > maxEntries {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	return prowYAML, nil
+}
+
+// copyProwYAML returns a deep copy of p. The compiled regexes of the jobs are
+// not serialized, so they are taken over from p. They are immutable and can
+// be shared.
+func copyProwYAML(p *ProwYAML) (*ProwYAML, error) {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var copied ProwYAML
+	if err := json.Unmarshal(raw, &copied); err != nil {
+		return nil, err
+	}
+	// SourcePath, Files and Defaulted are not serialized.
+	copied.SourcePath = p.SourcePath
+	copied.Files = append([]string(nil), p.Files...)
+	copied.Defaulted = p.Defaulted
+	for i := range copied.Presubmits {
+		copied.Presubmits[i].SourcePath = p.Presubmits[i].SourcePath
+		copied.Presubmits[i].re = p.Presubmits[i].re
+		copied.Presubmits[i].Brancher.re = p.Presubmits[i].Brancher.re
+		copied.Presubmits[i].Brancher.reSkip = p.Presubmits[i].Brancher.reSkip
+		copied.Presubmits[i].RegexpChangeMatcher.reChanges = p.Presubmits[i].RegexpChangeMatcher.reChanges
+	}
+	for i := range copied.Postsubmits {
+		copied.Postsubmits[i].SourcePath = p.Postsubmits[i].SourcePath
+		copied.Postsubmits[i].Brancher.re = p.Postsubmits[i].Brancher.re
+		copied.Postsubmits[i].Brancher.reSkip = p.Postsubmits[i].Brancher.reSkip
+		copied.Postsubmits[i].RegexpChangeMatcher.reChanges = p.Postsubmits[i].RegexpChangeMatcher.reChanges
+	}
+	return &copied, nil
+}
+
+// defaultNegativeProwYAMLCache is the negative cache used by the default
+// ProwYAMLGetter.
+var defaultNegativeProwYAMLCache = &negativeProwYAMLCache{}
+
+// negativeProwYAMLCache remembers for a while which combinations of a
+// repository and SHAs have no in-repo config file, so they don't need to be
+// cloned again.
+type negativeProwYAMLCache struct {
+	lock    sync.Mutex
+	entries map[string]negativeProwYAMLCacheEntry
+}
+
+type negativeProwYAMLCacheEntry struct {
+	// head is the SHA of the commit that was checked out.
+	head    string
+	expires time.Time
+}
+
+// get returns the head SHA cached for key and whether there was an entry for
+// key that didn't expire before now.
+func (c *negativeProwYAMLCache) get(key string, now time.Time) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		inRepoConfigNegativeCacheLookups.WithLabelValues("miss").Inc()
+		return "", false
+	}
+	inRepoConfigNegativeCacheLookups.WithLabelValues("hit").Inc()
+	return entry.head, true
+}
+
+// add caches that there is no in-repo config for key until expires. Entries
+// that are expired at now are removed.
+func (c *negativeProwYAMLCache) add(key, head string, now, expires time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]negativeProwYAMLCacheEntry{}
+	}
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = negativeProwYAMLCacheEntry{head: head, expires: expires}
+}
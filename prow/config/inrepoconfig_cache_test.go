@@ -0,0 +1,149 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestProwYAMLCache(t *testing.T) {
+	var reads int
+	read := func(name string) func() (*ProwYAML, error) {
+		return func() (*ProwYAML, error) {
+			reads++
+			return &ProwYAML{SourcePath: ".prow.yaml", Presubmits: []Presubmit{{JobBase: JobBase{
+				Name:       name,
+				SourcePath: ".prow.yaml",
+				Spec:       &v1.PodSpec{Containers: []v1.Container{{Image: "golang"}}},
+			}}}}, nil
+		}
+	}
+	cache := &prowYAMLCache{}
+
+	first, err := cache.getOrRead("a", 2, read("hans"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first.Presubmits[0].Spec.Containers[0].Image = "alpine"
+
+	second, err := cache.getOrRead("a", 2, read("kurt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reads != 1 {
+		t.Errorf("expected the second lookup to be a hit, got %d reads", reads)
+	}
+	expected := &ProwYAML{SourcePath: ".prow.yaml", Presubmits: []Presubmit{{JobBase: JobBase{
+		Name:       "hans",
+		SourcePath: ".prow.yaml",
+		Spec:       &v1.PodSpec{Containers: []v1.Container{{Image: "golang"}}},
+	}}}}
+	if diff := cmp.Diff(expected, second, cmpopts.IgnoreUnexported(Presubmit{}, Brancher{}, RegexpChangeMatcher{})); diff != "" {
+		t.Errorf("cached ProwYAML differs from expected: %s", diff)
+	}
+
+	if _, err := cache.getOrRead("b", 2, read("b")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := cache.getOrRead("c", 2, read("c")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := cache.entries["a"]; ok {
+		t.Error("expected the oldest entry to be evicted")
+	}
+	if n := len(cache.entries); n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+
+	failingRead := func() (*ProwYAML, error) { return nil, errors.New("injected") }
+	if _, err := cache.getOrRead("d", 2, failingRead); err == nil || err.Error() != "injected" {
+		t.Errorf("expected injected error, got %v", err)
+	}
+	if _, ok := cache.entries["d"]; ok {
+		t.Error("expected errors to not be cached")
+	}
+}
+
+func TestCopyProwYAMLKeepsRegexes(t *testing.T) {
+	p := &ProwYAML{
+		Presubmits: []Presubmit{{
+			JobBase:             JobBase{Name: "hans"},
+			Trigger:             `(?m)^/test hans`,
+			RerunCommand:        "/test hans",
+			Brancher:            Brancher{Branches: []string{"master"}, SkipBranches: []string{"release"}},
+			RegexpChangeMatcher: RegexpChangeMatcher{RunIfChanged: `\.go$`},
+		}},
+		Postsubmits: []Postsubmit{{
+			JobBase:             JobBase{Name: "kurt"},
+			Brancher:            Brancher{Branches: []string{"master"}},
+			RegexpChangeMatcher: RegexpChangeMatcher{RunIfChanged: `\.go$`},
+		}},
+	}
+	if err := SetPresubmitRegexes(p.Presubmits); err != nil {
+		t.Fatalf("failed to set presubmit regexes: %v", err)
+	}
+	if err := SetPostsubmitRegexes(p.Postsubmits); err != nil {
+		t.Fatalf("failed to set postsubmit regexes: %v", err)
+	}
+
+	copied, err := copyProwYAML(p)
+	if err != nil {
+		t.Fatalf("failed to copy: %v", err)
+	}
+	pre := copied.Presubmits[0]
+	if !pre.TriggerMatches("/test hans") {
+		t.Error("expected the trigger of the copied presubmit to match")
+	}
+	if !pre.Brancher.ShouldRun("master") || pre.Brancher.ShouldRun("release") {
+		t.Error("expected the branch regexes of the copied presubmit to be set")
+	}
+	if !pre.RunsAgainstChanges([]string{"main.go"}) || pre.RunsAgainstChanges([]string{"README.md"}) {
+		t.Error("expected the change regex of the copied presubmit to be set")
+	}
+	post := copied.Postsubmits[0]
+	if !post.Brancher.ShouldRun("master") || post.Brancher.ShouldRun("other") {
+		t.Error("expected the branch regex of the copied postsubmit to be set")
+	}
+	if !post.RunsAgainstChanges([]string{"main.go"}) || post.RunsAgainstChanges([]string{"README.md"}) {
+		t.Error("expected the change regex of the copied postsubmit to be set")
+	}
+}
+
+func TestNegativeProwYAMLCache(t *testing.T) {
+	cache := &negativeProwYAMLCache{}
+	now := time.Now()
+
+	if _, ok := cache.get("a", now); ok {
+		t.Error("expected a miss in an empty cache")
+	}
+	cache.add("a", "head", now, now.Add(time.Hour))
+	if head, ok := cache.get("a", now); !ok || head != "head" {
+		t.Errorf("expected a hit with head %q, got %q, %t", "head", head, ok)
+	}
+	if _, ok := cache.get("a", now.Add(time.Hour)); ok {
+		t.Error("expected a miss after the entry expired")
+	}
+	if _, ok := cache.entries["a"]; ok {
+		t.Error("expected the expired entry to be removed")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PresubmitExplanation explains why a presubmit runs automatically for a
+// pull request or not.
+type PresubmitExplanation struct {
+	// Name is the name of the presubmit.
+	Name string `json:"name"`
+	// Runs is whether the presubmit runs without being requested explicitly.
+	Runs bool `json:"runs"`
+	// MatchesBranch is whether the branches and skip_branches of the
+	// presubmit allow it to run against the base ref.
+	MatchesBranch bool `json:"matches_branch"`
+	// AlwaysRun is whether always_run is set.
+	AlwaysRun bool `json:"always_run,omitempty"`
+	// RunIfChanged is the run_if_changed regex of the presubmit.
+	RunIfChanged string `json:"run_if_changed,omitempty"`
+	// MatchedFiles are the changed files that match RunIfChanged.
+	MatchedFiles []string `json:"matched_files,omitempty"`
+	// Reason tells the deciding reason in a human-readable form.
+	Reason string `json:"reason"`
+}
+
+// ExplainPresubmits explains for every presubmit of p why it runs or doesn't
+// run automatically for a pull request against baseRef that changes the files
+// changes. The decisions are the same Presubmit.ShouldRun makes if the
+// presubmit is neither forced nor run by default. p must have been defaulted,
+// e.g. by the ProwYAMLGetter.
+func ExplainPresubmits(p *ProwYAML, baseRef string, changes []string) []PresubmitExplanation {
+	var explanations []PresubmitExplanation
+	for _, ps := range p.Presubmits {
+		explanations = append(explanations, explainPresubmit(ps, baseRef, changes))
+	}
+	return explanations
+}
+
+func explainPresubmit(ps Presubmit, baseRef string, changes []string) PresubmitExplanation {
+	e := PresubmitExplanation{
+		Name:          ps.Name,
+		MatchesBranch: ps.CouldRun(baseRef),
+		AlwaysRun:     ps.AlwaysRun,
+		RunIfChanged:  ps.RunIfChanged,
+	}
+	if ps.RegexpChangeMatcher.CouldRun() {
+		for _, change := range changes {
+			if ps.reChanges.MatchString(change) {
+				e.MatchedFiles = append(e.MatchedFiles, change)
+			}
+		}
+	}
+
+	switch {
+	case !e.MatchesBranch && len(ps.SkipBranches) != 0 && ps.reSkip.MatchString(baseRef):
+		e.Reason = fmt.Sprintf("the base branch %q matches skip_branches %q", baseRef, ps.SkipBranches)
+	case !e.MatchesBranch:
+		e.Reason = fmt.Sprintf("the base branch %q matches none of branches %q", baseRef, ps.Branches)
+	case ps.AlwaysRun:
+		e.Runs = true
+		e.Reason = "always_run is set"
+	case len(e.MatchedFiles) > 0:
+		e.Runs = true
+		e.Reason = fmt.Sprintf("the changed files %s match run_if_changed %q", strings.Join(e.MatchedFiles, ", "), ps.RunIfChanged)
+	case ps.RegexpChangeMatcher.CouldRun():
+		e.Reason = fmt.Sprintf("no changed file matches run_if_changed %q", ps.RunIfChanged)
+	default:
+		e.Reason = fmt.Sprintf("neither always_run nor run_if_changed is set, so it only runs when requested with %q", ps.RerunCommand)
+	}
+	return e
+}
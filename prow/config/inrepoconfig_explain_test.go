@@ -0,0 +1,109 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExplainPresubmits(t *testing.T) {
+	p := &ProwYAML{Presubmits: []Presubmit{
+		{
+			JobBase:   JobBase{Name: "always"},
+			AlwaysRun: true,
+		},
+		{
+			JobBase:             JobBase{Name: "go-changes"},
+			RegexpChangeMatcher: RegexpChangeMatcher{RunIfChanged: `\.go$`},
+		},
+		{
+			JobBase:             JobBase{Name: "docs-changes"},
+			RegexpChangeMatcher: RegexpChangeMatcher{RunIfChanged: `^docs/`},
+		},
+		{
+			JobBase:  JobBase{Name: "release-only"},
+			Brancher: Brancher{Branches: []string{"release-.*"}},
+		},
+		{
+			JobBase:   JobBase{Name: "skips-master"},
+			AlwaysRun: true,
+			Brancher:  Brancher{SkipBranches: []string{"master"}},
+		},
+		{
+			JobBase:  JobBase{Name: "manual"},
+			Reporter: Reporter{Context: "manual"},
+		},
+	}}
+	if err := defaultPresubmits(p.Presubmits, &Config{}, "org/repo"); err != nil {
+		t.Fatalf("failed to default presubmits: %v", err)
+	}
+	changes := []string{"main.go", "pkg/util.go", "README.md"}
+
+	expected := []PresubmitExplanation{
+		{
+			Name:          "always",
+			Runs:          true,
+			MatchesBranch: true,
+			AlwaysRun:     true,
+			Reason:        "always_run is set",
+		},
+		{
+			Name:          "go-changes",
+			Runs:          true,
+			MatchesBranch: true,
+			RunIfChanged:  `\.go$`,
+			MatchedFiles:  []string{"main.go", "pkg/util.go"},
+			Reason:        `the changed files main.go, pkg/util.go match run_if_changed "\\.go$"`,
+		},
+		{
+			Name:          "docs-changes",
+			MatchesBranch: true,
+			RunIfChanged:  `^docs/`,
+			Reason:        `no changed file matches run_if_changed "^docs/"`,
+		},
+		{
+			Name:   "release-only",
+			Reason: `the base branch "master" matches none of branches ["release-.*"]`,
+		},
+		{
+			Name:      "skips-master",
+			AlwaysRun: true,
+			Reason:    `the base branch "master" matches skip_branches ["master"]`,
+		},
+		{
+			Name:          "manual",
+			MatchesBranch: true,
+			Reason:        `neither always_run nor run_if_changed is set, so it only runs when requested with "/test manual"`,
+		},
+	}
+	actual := ExplainPresubmits(p, "master", changes)
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("explanations differ from expected: %s", diff)
+	}
+
+	for i, ps := range p.Presubmits {
+		shouldRun, err := ps.ShouldRun("master", func() ([]string, error) { return changes, nil }, false, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if actual[i].Runs != shouldRun {
+			t.Errorf("expected the explanation of %s to agree with ShouldRun, which returned %t", ps.Name, shouldRun)
+		}
+	}
+}
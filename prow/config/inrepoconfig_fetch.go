@@ -0,0 +1,184 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/git/v2"
+	"k8s.io/test-infra/prow/github"
+)
+
+// ProwYAMLFileFetcher gets single files of a repository at a commit, so its
+// in-repo config can be read without cloning it.
+type ProwYAMLFileFetcher interface {
+	// FetchFile returns the content of the file at the slash-separated path
+	// relative to the root of the repository at sha. If the file doesn't exist,
+	// the error must satisfy os.IsNotExist.
+	FetchFile(path, sha string) ([]byte, error)
+}
+
+type githubFileGetter interface {
+	GetFile(org, repo, filepath, commit string) ([]byte, error)
+}
+
+// NewGitHubProwYAMLFileFetcher returns a ProwYAMLFileFetcher that gets the
+// files of org/repo from the contents API of GitHub.
+func NewGitHubProwYAMLFileFetcher(client githubFileGetter, org, repo string) ProwYAMLFileFetcher {
+	return &githubProwYAMLFileFetcher{client: client, org: org, repo: repo}
+}
+
+type githubProwYAMLFileFetcher struct {
+	client    githubFileGetter
+	org, repo string
+}
+
+func (f *githubProwYAMLFileFetcher) FetchFile(path, sha string) ([]byte, error) {
+	content, err := f.client.GetFile(f.org, f.repo, path, sha)
+	if _, ok := err.(*github.FileNotFound); ok {
+		return nil, &os.PathError{Op: "get", Path: path, Err: os.ErrNotExist}
+	}
+	return content, err
+}
+
+// NewGitProwYAMLFileFetcher returns a ProwYAMLFileFetcher that gets the files
+// from the git objects of repo, e.g. a clone that is kept around, without
+// checking them out.
+func NewGitProwYAMLFileFetcher(repo git.RepoClient) ProwYAMLFileFetcher {
+	return &gitProwYAMLFileFetcher{repo: repo}
+}
+
+type gitProwYAMLFileFetcher struct {
+	repo git.RepoClient
+}
+
+func (f *gitProwYAMLFileFetcher) FetchFile(path, sha string) ([]byte, error) {
+	return f.repo.ShowFile(sha, path)
+}
+
+// ProwYAMLFromFetcher reads the in-repo config of the repository identified
+// by identifier at sha like ProwYAMLFromDir, but gets only the in-repo config
+// files from fetcher, e.g. for linting a pull request without cloning the
+// repository. The read ProwYAML is defaulted and validated. As fetchers don't
+// tell symlinks apart from files, in-repo config files must not be symlinks.
+func ProwYAMLFromFetcher(c *Config, fetcher ProwYAMLFileFetcher, identifier, sha string) (*ProwYAML, error) {
+	if err := validateSHA(sha); err != nil {
+		return nil, fmt.Errorf("invalid SHA: %v", err)
+	}
+	log := logrus.WithFields(logrus.Fields{"repo": identifier, "sha": sha})
+	opts := prowYAMLReadOpts{
+		basePath:    c.InRepoConfigBasePath(identifier),
+		fileName:    c.InRepoConfigFileName(identifier),
+		strict:      c.InRepoConfigStrict(identifier),
+		maxFileSize: c.InRepoConfig.MaxFileSize,
+		signingKey:  c.InRepoConfigSigningKey(identifier),
+		rejectEmpty: c.InRepoConfigRejectEmptyFiles(identifier),
+	}
+	prowYAML, err := readProwYAMLFrom(log, &fetchedFiles{fetcher: fetcher, sha: sha, contents: map[string][]byte{}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := defaultAndValidateReadProwYAML(c, prowYAML, identifier); err != nil {
+		return nil, err
+	}
+	return prowYAML, nil
+}
+
+// fetchedFiles are the files of a repository at sha that are fetched on
+// demand. They are all treated as regular files.
+type fetchedFiles struct {
+	fetcher ProwYAMLFileFetcher
+	sha     string
+	// contents holds the content of every file that was fetched, so it is
+	// only fetched once.
+	contents map[string][]byte
+}
+
+func (f *fetchedFiles) fetch(name string) ([]byte, error) {
+	if content, ok := f.contents[name]; ok {
+		return content, nil
+	}
+	content, err := f.fetcher.FetchFile(name, f.sha)
+	if err != nil {
+		return nil, err
+	}
+	f.contents[name] = content
+	return content, nil
+}
+
+func (f *fetchedFiles) lstat(name string) (os.FileInfo, error) {
+	content, err := f.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+	return fetchedFileInfo{name: name, size: int64(len(content))}, nil
+}
+
+func (f *fetchedFiles) resolveSymlink(name string) (string, error) {
+	return name, nil
+}
+
+func (f *fetchedFiles) readFile(name string) ([]byte, error) {
+	return f.fetch(name)
+}
+
+// objectFiles are the files of a repository at sha that are read from its git
+// objects without checking them out. Symlinks can't be resolved.
+type objectFiles struct {
+	repo git.ObjectReader
+	sha  string
+	// infos holds the information about every file that was looked up, so
+	// only regular files are read.
+	infos map[string]os.FileInfo
+}
+
+func (f *objectFiles) lstat(name string) (os.FileInfo, error) {
+	info, err := f.repo.StatFile(f.sha, name)
+	if err != nil {
+		return nil, err
+	}
+	f.infos[name] = info
+	return info, nil
+}
+
+func (f *objectFiles) resolveSymlink(name string) (string, error) {
+	return "", fmt.Errorf("symlink %q can not be resolved without a checkout", name)
+}
+
+func (f *objectFiles) readFile(name string) ([]byte, error) {
+	if info, ok := f.infos[name]; ok && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%q is not a regular file", name)
+	}
+	return f.repo.ShowFile(f.sha, name)
+}
+
+// fetchedFileInfo is the os.FileInfo of a fetched regular file.
+type fetchedFileInfo struct {
+	name string
+	size int64
+}
+
+func (i fetchedFileInfo) Name() string       { return i.name }
+func (i fetchedFileInfo) Size() int64        { return i.size }
+func (i fetchedFileInfo) Mode() os.FileMode  { return 0644 }
+func (i fetchedFileInfo) ModTime() time.Time { return time.Time{} }
+func (i fetchedFileInfo) IsDir() bool        { return false }
+func (i fetchedFileInfo) Sys() interface{}   { return nil }
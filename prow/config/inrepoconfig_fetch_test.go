@@ -0,0 +1,186 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/test-infra/prow/git/localgit"
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/kube"
+)
+
+// fakeGitHubFileGetter serves files by path at the SHA it was created for.
+type fakeGitHubFileGetter struct {
+	sha   string
+	files map[string]string
+	err   error
+	calls []string
+}
+
+func (f *fakeGitHubFileGetter) GetFile(org, repo, filepath, commit string) ([]byte, error) {
+	f.calls = append(f.calls, filepath)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if org != "org" || repo != "repo" {
+		return nil, errors.New("unexpected repo")
+	}
+	content, ok := f.files[filepath]
+	if !ok || commit != f.sha {
+		return nil, &github.FileNotFound{}
+	}
+	return []byte(content), nil
+}
+
+func TestProwYAMLFromFetcher(t *testing.T) {
+	const sha = "e2ae5a5b"
+	testCases := []struct {
+		name               string
+		files              map[string]string
+		err                error
+		expectedPresubmits []string
+		expectedCalls      []string
+		expectedErr        string
+	}{
+		{
+			name:               "YAML file",
+			files:              map[string]string{".prow.yaml": `presubmits: [{"name": "hans", "spec": {"containers": [{}]}}]`},
+			expectedPresubmits: []string{"hans"},
+			expectedCalls:      []string{".prow.yaml"},
+		},
+		{
+			name:               "JSON file if there is no YAML file",
+			files:              map[string]string{".prow.json": `{"presubmits": [{"name": "hans", "spec": {"containers": [{}]}}]}`},
+			expectedPresubmits: []string{"hans"},
+			expectedCalls:      []string{".prow.yaml", ".prow.json"},
+		},
+		{
+			name: "Included files",
+			files: map[string]string{
+				".prow.yaml":   `{"include": ["ci/jobs.yaml"], "presubmits": [{"name": "hans", "spec": {"containers": [{}]}}]}`,
+				"ci/jobs.yaml": `presubmits: [{"name": "kurt", "spec": {"containers": [{}]}}]`,
+			},
+			expectedPresubmits: []string{"hans", "kurt"},
+			expectedCalls:      []string{".prow.yaml", "ci/jobs.yaml"},
+		},
+		{
+			name:          "No file",
+			expectedCalls: []string{".prow.yaml", ".prow.json"},
+		},
+		{
+			name:          "Fetching fails",
+			err:           errors.New("rate limited"),
+			expectedCalls: []string{".prow.yaml"},
+			expectedErr:   `failed to check if file ".prow.yaml" exists: rate limited`,
+		},
+		{
+			name:          "Invalid job",
+			files:         map[string]string{".prow.yaml": `presubmits: [{"name": "hans"}]`},
+			expectedCalls: []string{".prow.yaml"},
+			expectedErr:   `invalid presubmit job hans: kubernetes jobs require a spec`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{ProwConfig: ProwConfig{
+				PodNamespace: "my-ns",
+				InRepoConfig: InRepoConfig{AllowedClusters: map[string][]string{"*": {kube.DefaultClusterAlias}}},
+			}}
+			client := &fakeGitHubFileGetter{sha: sha, files: tc.files, err: tc.err}
+			p, err := ProwYAMLFromFetcher(cfg, NewGitHubProwYAMLFileFetcher(client, "org", "repo"), "org/repo", sha)
+			var actualErr string
+			if err != nil {
+				actualErr = err.Error()
+			}
+			if actualErr != tc.expectedErr {
+				t.Fatalf("expected error %q, got %q", tc.expectedErr, actualErr)
+			}
+			if diff := cmp.Diff(tc.expectedCalls, client.calls); diff != "" {
+				t.Errorf("fetched files differ from expected: %s", diff)
+			}
+			if err != nil {
+				return
+			}
+			var presubmits []string
+			for _, pre := range p.Presubmits {
+				presubmits = append(presubmits, pre.Name)
+			}
+			if diff := cmp.Diff(tc.expectedPresubmits, presubmits); diff != "" {
+				t.Errorf("presubmits differ from expected: %s", diff)
+			}
+		})
+	}
+}
+
+func TestProwYAMLFromGitFetcher(t *testing.T) {
+	lg, gc, err := localgit.NewV2()
+	if err != nil {
+		t.Fatalf("Making local git repo: %v", err)
+	}
+	defer func() {
+		if err := lg.Clean(); err != nil {
+			t.Errorf("Error cleaning LocalGit: %v", err)
+		}
+		if err := gc.Clean(); err != nil {
+			t.Errorf("Error cleaning Client: %v", err)
+		}
+	}()
+	if err := lg.MakeFakeRepo("org", "repo"); err != nil {
+		t.Fatalf("Making fake repo: %v", err)
+	}
+	if err := lg.AddCommit("org", "repo", map[string][]byte{
+		".prow.yaml":   []byte(`{"include": ["ci/jobs.yaml"], "presubmits": [{"name": "hans", "spec": {"containers": [{}]}}]}`),
+		"ci/jobs.yaml": []byte(`presubmits: [{"name": "kurt", "spec": {"containers": [{}]}}]`),
+	}); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	sha, err := lg.RevParse("org", "repo", "master")
+	if err != nil {
+		t.Fatalf("failed to get SHA: %v", err)
+	}
+	repo, err := gc.ClientFor("org", "repo")
+	if err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+	defer func() {
+		if err := repo.Clean(); err != nil {
+			t.Errorf("Error cleaning repo: %v", err)
+		}
+	}()
+
+	cfg := &Config{ProwConfig: ProwConfig{
+		PodNamespace: "my-ns",
+		InRepoConfig: InRepoConfig{AllowedClusters: map[string][]string{"*": {kube.DefaultClusterAlias}}},
+	}}
+	p, err := ProwYAMLFromFetcher(cfg, NewGitProwYAMLFileFetcher(repo), "org/repo", strings.TrimSpace(sha))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var presubmits []string
+	for _, pre := range p.Presubmits {
+		presubmits = append(presubmits, pre.Name)
+	}
+	if diff := cmp.Diff([]string{"hans", "kurt"}, presubmits); diff != "" {
+		t.Errorf("presubmits differ from expected: %s", diff)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// ValidateProwYAMLSchema validates the raw content of a .prow.yaml or
+// .prow.json file against the schema given by the ProwYAML type. Unlike
+// unmarshalling, it doesn't stop at the first problem but returns an error for
+// every unknown field and every value of the wrong type, each prefixed with
+// the path of the field, e.g. "presubmits[0].spec.containers[0].image".
+// Values of types with custom unmarshalling, like durations, are not checked.
+func ValidateProwYAMLSchema(data []byte) []error {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return []error{err}
+	}
+	var doc interface{}
+	if err := json.Unmarshal(jsonData, &doc); err != nil {
+		return []error{err}
+	}
+	return validateSchemaValue("", doc, reflect.TypeOf(ProwYAML{}))
+}
+
+func validateSchemaValue(fieldPath string, value interface{}, t reflect.Type) []error {
+	if value == nil || t.Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	mismatch := func(expected string) []error {
+		return []error{fmt.Errorf("%s: expected %s, got %s", displayFieldPath(fieldPath), expected, schemaTypeOf(value))}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return validateSchemaValue(fieldPath, value, t.Elem())
+	case reflect.Interface:
+		return nil
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch("object")
+		}
+		fields := map[string]reflect.Type{}
+		collectSchemaFields(t, fields)
+		var errs []error
+		for _, key := range sortedKeys(object) {
+			fieldType, known := fields[key]
+			if !known {
+				errs = append(errs, fmt.Errorf("%s: unknown field", displayFieldPath(joinFieldPath(fieldPath, key))))
+				continue
+			}
+			errs = append(errs, validateSchemaValue(joinFieldPath(fieldPath, key), object[key], fieldType)...)
+		}
+		return errs
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch("object")
+		}
+		var errs []error
+		for _, key := range sortedKeys(object) {
+			errs = append(errs, validateSchemaValue(fmt.Sprintf("%s[%q]", fieldPath, key), object[key], t.Elem())...)
+		}
+		return errs
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			if _, ok := value.(string); !ok {
+				return mismatch("string")
+			}
+			return nil
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return mismatch("array")
+		}
+		var errs []error
+		for i, item := range list {
+			errs = append(errs, validateSchemaValue(fmt.Sprintf("%s[%d]", fieldPath, i), item, t.Elem())...)
+		}
+		return errs
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return mismatch("string")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return mismatch("boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			return mismatch("integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			return mismatch("number")
+		}
+	}
+	return nil
+}
+
+// collectSchemaFields adds the JSON names and types of all fields of the
+// struct type t to fields, including those of embedded structs.
+func collectSchemaFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				collectSchemaFields(embedded, fields)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+}
+
+func schemaTypeOf(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func joinFieldPath(fieldPath, name string) string {
+	if fieldPath == "" {
+		return name
+	}
+	return fieldPath + "." + name
+}
+
+func displayFieldPath(fieldPath string) string {
+	if fieldPath == "" {
+		return "<root>"
+	}
+	return fieldPath
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateProwYAMLSchema(t *testing.T) {
+	testCases := []struct {
+		name         string
+		content      string
+		expectedErrs []string
+	}{
+		{
+			name: "Valid file",
+			content: `
+presubmits:
+- name: hans
+  always_run: true
+  max_concurrency: 2
+  branches: [master]
+  decorate: true
+  decoration_config:
+    timeout: 1h
+  labels:
+    team: a
+  spec:
+    containers:
+    - image: golang
+      command: [go, test]
+      resources:
+        requests:
+          cpu: 2
+postsubmits:
+- name: kurt
+  run_if_changed: '^docs/'
+`,
+		},
+		{
+			name:    "Valid json file",
+			content: `{"presubmits": [{"name": "hans", "spec": {"containers": [{"image": "golang"}]}}]}`,
+		},
+		{
+			name:    "Empty file",
+			content: ``,
+		},
+		{
+			name: "Unknown fields",
+			content: `
+presubmits:
+- name: hans
+  undef_attr: true
+  spec:
+    containers:
+    - imgae: golang
+`,
+			expectedErrs: []string{
+				"presubmits[0].spec.containers[0].imgae: unknown field",
+				"presubmits[0].undef_attr: unknown field",
+			},
+		},
+		{
+			name: "Type mismatches",
+			content: `
+presubmits:
+- name: [hans]
+  always_run: "yes"
+  max_concurrency: 1.5
+  labels: team
+postsubmits: {}
+`,
+			expectedErrs: []string{
+				"postsubmits: expected array, got object",
+				"presubmits[0].always_run: expected boolean, got string",
+				"presubmits[0].labels: expected object, got string",
+				"presubmits[0].max_concurrency: expected integer, got number",
+				"presubmits[0].name: expected string, got array",
+			},
+		},
+		{
+			name:         "Document that is not an object",
+			content:      `- name: hans`,
+			expectedErrs: []string{"<root>: expected object, got array"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var actualErrs []string
+			for _, err := range ValidateProwYAMLSchema([]byte(tc.content)) {
+				actualErrs = append(actualErrs, err.Error())
+			}
+			if diff := cmp.Diff(tc.expectedErrs, actualErrs); diff != "" {
+				t.Errorf("errors differ from expected: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxTarSymlinkHops is the maximum number of symlinks that are followed to
+// resolve a symlink in a tar archive.
+const maxTarSymlinkHops = 40
+
+// ReadProwYAMLFromTar is like ReadProwYAML, but reads the files from a tar
+// archive of the repository instead of a directory. The paths in the archive
+// must be relative to the root of the repository. Symlinks are ignored unless
+// allowSymlinks is set, symlinks to directories are never followed. Only the
+// headers of the archive are kept in memory; the content of a file is read
+// from r when it is needed, so r must be seekable. Callers with a stream that
+// can't seek, e.g. the body of an HTTP response, need to buffer it first, e.g.
+// in a temporary file. Files bigger than DefaultInRepoConfigMaxFileSize are
+// rejected.
+func ReadProwYAMLFromTar(log *logrus.Entry, r io.ReadSeeker, strict, allowSymlinks bool) (*ProwYAML, error) {
+	opts := prowYAMLReadOpts{strict: strict, maxFileSize: DefaultInRepoConfigMaxFileSize, allowSymlinks: allowSymlinks}
+	files, err := readTarFiles(r, opts.maxFileSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tar archive: %v", err)
+	}
+	return readProwYAMLFrom(log, files, opts)
+}
+
+// tarFiles are the files of a tar archive. Their content is read lazily from
+// the archive.
+type tarFiles struct {
+	r io.ReadSeeker
+	// entries are the entries of the archive by their cleaned name. If a name
+	// occurs multiple times, the last entry wins.
+	entries map[string]*tarEntry
+	// maxFileSize is the maximum size in bytes of a file that is read. Zero
+	// means there is no limit.
+	maxFileSize int64
+}
+
+type tarEntry struct {
+	header *tar.Header
+	// index is the position of the entry in the archive.
+	index int
+}
+
+// readTarFiles reads the headers of all entries of the tar archive. The
+// content of regular files that are not bigger than maxFileSize can be read
+// later on, unless maxFileSize is zero, which means there is no limit.
+func readTarFiles(r io.ReadSeeker, maxFileSize int64) (*tarFiles, error) {
+	files := &tarFiles{r: r, entries: map[string]*tarEntry{}, maxFileSize: maxFileSize}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		// Next skips the content of the previous entry by seeking.
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		files.entries[path.Clean(strings.TrimPrefix(header.Name, "/"))] = &tarEntry{header: header, index: index}
+	}
+}
+
+func (t *tarFiles) lstat(name string) (os.FileInfo, error) {
+	file, ok := t.entries[name]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return file.header.FileInfo(), nil
+}
+
+func (t *tarFiles) resolveSymlink(name string) (string, error) {
+	for i := 0; i < maxTarSymlinkHops; i++ {
+		file, ok := t.entries[name]
+		if !ok {
+			return "", &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+		}
+		if file.header.Typeflag != tar.TypeSymlink {
+			return name, nil
+		}
+		target := file.header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		target, err := cleanRepoPath(target)
+		if err != nil {
+			return "", fmt.Errorf("target %q is outside of the repository", file.header.Linkname)
+		}
+		name = target
+	}
+	return "", fmt.Errorf("too many levels of symbolic links")
+}
+
+func (t *tarFiles) readFile(name string) ([]byte, error) {
+	file, ok := t.entries[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if file.header.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("%q is not a regular file", name)
+	}
+	if t.maxFileSize > 0 && file.header.Size > t.maxFileSize {
+		return nil, fmt.Errorf("%q has a size of %d bytes, which exceeds the maximum of %d bytes", name, file.header.Size, t.maxFileSize)
+	}
+	if _, err := t.r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind tar archive: %v", err)
+	}
+	tr := tar.NewReader(t.r)
+	for index := 0; index <= file.index; index++ {
+		if _, err := tr.Next(); err != nil {
+			return nil, fmt.Errorf("failed to find %q in tar archive: %v", name, err)
+		}
+	}
+	return ioutil.ReadAll(tr)
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+func makeTar(t *testing.T, files map[string]string, symlinks map[string]string) *bytes.Reader {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("failed to write header for %q: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("failed to write %q: %v", name, err)
+		}
+	}
+	for name, target := range symlinks {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: target}); err != nil {
+			t.Fatalf("failed to write header for %q: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar writer: %v", err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestReadProwYAMLFromTar(t *testing.T) {
+	testCases := []struct {
+		name               string
+		files              map[string]string
+		symlinks           map[string]string
+		opts               prowYAMLReadOpts
+		expectedPresubmits []string
+		expectedErr        string
+	}{
+		{
+			name:               "Yaml file",
+			files:              map[string]string{".prow.yaml": `presubmits: [{"name": "hans"}]`},
+			expectedPresubmits: []string{"hans"},
+		},
+		{
+			name:               "Names with leading dot slash",
+			files:              map[string]string{"./.prow.yaml": `presubmits: [{"name": "hans"}]`},
+			expectedPresubmits: []string{"hans"},
+		},
+		{
+			name: "Yaml file takes precedence over json file",
+			files: map[string]string{
+				".prow.yaml": `presubmits: [{"name": "hans"}]`,
+				".prow.json": `{"presubmits": [{"name": "kurt"}]}`,
+			},
+			expectedPresubmits: []string{"hans"},
+		},
+		{
+			name:  "No file",
+			files: map[string]string{"README.md": "hello"},
+		},
+		{
+			name:               "File in base path",
+			files:              map[string]string{"component-a/.prow.yaml": `presubmits: [{"name": "hans"}]`},
+			opts:               prowYAMLReadOpts{basePath: "component-a"},
+			expectedPresubmits: []string{"hans"},
+		},
+		{
+			name:        "File exceeding the maximum size is rejected",
+			files:       map[string]string{".prow.yaml": `presubmits: [{"name": "hans"}]`},
+			opts:        prowYAMLReadOpts{maxFileSize: 10},
+			expectedErr: `file ".prow.yaml" has a size of 30 bytes, which exceeds the maximum of 10 bytes`,
+		},
+		{
+			name: "Unrelated files exceeding the maximum size don't matter",
+			files: map[string]string{
+				".prow.yaml": `include: [jobs.yaml]`,
+				"jobs.yaml":  `presubmits: [{"name": "hans"}]`,
+				"big.bin":    strings.Repeat("x", 100),
+			},
+			opts:               prowYAMLReadOpts{maxFileSize: 50},
+			expectedPresubmits: []string{"hans"},
+		},
+		{
+			name:     "Symlink is ignored by default",
+			files:    map[string]string{"jobs.yaml": `presubmits: [{"name": "hans"}]`},
+			symlinks: map[string]string{".prow.yaml": "jobs.yaml"},
+		},
+		{
+			name:               "Symlink inside the repo is read when allowed",
+			files:              map[string]string{"ci/jobs.yaml": `presubmits: [{"name": "hans"}]`},
+			symlinks:           map[string]string{".prow.yaml": "ci/link.yaml", "ci/link.yaml": "jobs.yaml"},
+			opts:               prowYAMLReadOpts{allowSymlinks: true},
+			expectedPresubmits: []string{"hans"},
+		},
+		{
+			name:        "Symlink outside the repo is rejected when allowed",
+			symlinks:    map[string]string{".prow.yaml": "../jobs.yaml"},
+			opts:        prowYAMLReadOpts{allowSymlinks: true},
+			expectedErr: `failed to resolve symlink ".prow.yaml": target "../jobs.yaml" is outside of the repository`,
+		},
+		{
+			name:        "Absolute symlink is rejected when allowed",
+			symlinks:    map[string]string{".prow.yaml": "/etc/passwd"},
+			opts:        prowYAMLReadOpts{allowSymlinks: true},
+			expectedErr: `failed to resolve symlink ".prow.yaml": target "/etc/passwd" is outside of the repository`,
+		},
+		{
+			name: "Included files are read relative to the including file",
+			files: map[string]string{
+				".prow.yaml":            `{"include": ["ci/jobs.yaml"], "presubmits": [{"name": "hans"}]}`,
+				"ci/jobs.yaml":          `{"include": ["shared/common.yaml"], "presubmits": [{"name": "kurt"}]}`,
+				"ci/shared/common.yaml": `presubmits: [{"name": "otto"}]`,
+			},
+			expectedPresubmits: []string{"hans", "kurt", "otto"},
+		},
+		{
+			name: "File included twice is read once",
+			files: map[string]string{
+				".prow.yaml":  `include: [a.yaml, b.yaml]`,
+				"a.yaml":      `{"include": ["common.yaml"], "presubmits": [{"name": "hans"}]}`,
+				"b.yaml":      `{"include": ["common.yaml"], "presubmits": [{"name": "kurt"}]}`,
+				"common.yaml": `presubmits: [{"name": "otto"}]`,
+			},
+			expectedPresubmits: []string{"hans", "otto", "kurt"},
+		},
+		{
+			name: "Include cycle is rejected",
+			files: map[string]string{
+				".prow.yaml": `include: [a.yaml]`,
+				"a.yaml":     `include: [b.yaml]`,
+				"b.yaml":     `include: [a.yaml]`,
+			},
+			expectedErr: `include cycle: .prow.yaml -> a.yaml -> b.yaml -> a.yaml`,
+		},
+		{
+			name:        "Include outside of the repository is rejected",
+			files:       map[string]string{"component-a/.prow.yaml": `include: [../../jobs.yaml]`},
+			opts:        prowYAMLReadOpts{basePath: "component-a"},
+			expectedErr: `file "component-a/.prow.yaml" includes "../../jobs.yaml", which is outside of the repository`,
+		},
+		{
+			name:        "Missing include is rejected",
+			files:       map[string]string{".prow.yaml": `include: [jobs.yaml]`},
+			expectedErr: `failed to stat "jobs.yaml" included by ".prow.yaml": lstat jobs.yaml: file does not exist`,
+		},
+		{
+			name:        "Included symlink is rejected by default",
+			files:       map[string]string{".prow.yaml": `include: [link.yaml]`, "jobs.yaml": `presubmits: [{"name": "hans"}]`},
+			symlinks:    map[string]string{"link.yaml": "jobs.yaml"},
+			expectedErr: `file "link.yaml" is a symlink`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := readTarFiles(makeTar(t, tc.files, tc.symlinks), tc.opts.maxFileSize)
+			if err != nil {
+				t.Fatalf("failed to read tar: %v", err)
+			}
+			p, err := readProwYAMLFrom(logrus.WithField("test", tc.name), files, tc.opts)
+			var actualErr string
+			if err != nil {
+				actualErr = err.Error()
+			}
+			if actualErr != tc.expectedErr {
+				t.Fatalf("expected error %q, got %q", tc.expectedErr, actualErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var presubmits []string
+			for _, pre := range p.Presubmits {
+				presubmits = append(presubmits, pre.Name)
+			}
+			if diff := cmp.Diff(tc.expectedPresubmits, presubmits); diff != "" {
+				t.Errorf("presubmits differ from expected: %s", diff)
+			}
+		})
+	}
+}
+
+func TestReadProwYAMLFromTarStrict(t *testing.T) {
+	archive := func() *bytes.Reader {
+		return makeTar(t, map[string]string{".prow.yaml": `presubmits: [{"name": "hans", "undef_attr": true}]`}, nil)
+	}
+	if _, err := ReadProwYAMLFromTar(logrus.NewEntry(logrus.New()), archive(), false, false); err != nil {
+		t.Errorf("expected no error when not strict, got %v", err)
+	}
+	if _, err := ReadProwYAMLFromTar(logrus.NewEntry(logrus.New()), archive(), true, false); err == nil {
+		t.Error("expected an error when strict, got none")
+	}
+}
+
+func TestReadProwYAMLFromTarSymlinks(t *testing.T) {
+	testCases := []struct {
+		name               string
+		allowSymlinks      bool
+		expectedPresubmits []string
+		expectedErr        string
+	}{
+		{
+			name: "Symlinks are ignored by default",
+		},
+		{
+			name:               "Symlinks are read when allowed",
+			allowSymlinks:      true,
+			expectedPresubmits: []string{"hans", "kurt"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := makeTar(t, map[string]string{
+				"ci/jobs.yaml": `{"include": ["ci/lint.yaml"], "presubmits": [{"name": "hans"}]}`,
+				"ci/kurt.yaml": `presubmits: [{"name": "kurt"}]`,
+			}, map[string]string{".prow.yaml": "ci/link.yaml", "ci/link.yaml": "jobs.yaml", "ci/lint.yaml": "kurt.yaml"})
+			p, err := ReadProwYAMLFromTar(logrus.WithField("test", tc.name), archive, false, tc.allowSymlinks)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var presubmits []string
+			for _, pre := range p.Presubmits {
+				presubmits = append(presubmits, pre.Name)
+			}
+			if diff := cmp.Diff(tc.expectedPresubmits, presubmits); diff != "" {
+				t.Errorf("presubmits differ from expected: %s", diff)
+			}
+		})
+	}
+
+	archive := makeTar(t, nil, map[string]string{".prow.yaml": "../jobs.yaml"})
+	expectedErr := `failed to resolve symlink ".prow.yaml": target "../jobs.yaml" is outside of the repository`
+	if _, err := ReadProwYAMLFromTar(logrus.WithField("test", t.Name()), archive, false, true); err == nil || err.Error() != expectedErr {
+		t.Errorf("expected error %q for a symlink outside of the repository, got %v", expectedErr, err)
+	}
+}
+
+func TestReadProwYAMLFromTarMaxFileSize(t *testing.T) {
+	archive := makeTar(t, map[string]string{".prow.yaml": "# " + strings.Repeat("x", DefaultInRepoConfigMaxFileSize)}, nil)
+	_, err := ReadProwYAMLFromTar(logrus.NewEntry(logrus.New()), archive, false, false)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("expected an error about the file size, got %v", err)
+	}
+}
+
+func TestTarFilesReadFile(t *testing.T) {
+	files, err := readTarFiles(makeTar(t, map[string]string{"a.yaml": "a", "b.yaml": "b", "c.yaml": "c"}, map[string]string{"link.yaml": "a.yaml"}), 0)
+	if err != nil {
+		t.Fatalf("failed to read tar: %v", err)
+	}
+	// Files are read in another order than they appear in the archive, and
+	// some more than once.
+	for _, name := range []string{"c.yaml", "a.yaml", "b.yaml", "a.yaml"} {
+		content, err := files.readFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if expected := strings.TrimSuffix(name, ".yaml"); string(content) != expected {
+			t.Errorf("expected %q to contain %q, got %q", name, expected, content)
+		}
+	}
+	if _, err := files.readFile("link.yaml"); err == nil {
+		t.Error("expected an error reading a symlink, got none")
+	}
+	if _, err := files.readFile("missing.yaml"); err == nil {
+		t.Error("expected an error reading a missing file, got none")
+	}
+}
@@ -122,6 +122,10 @@ type JobBase struct {
 	// Presubmits and Postsubmits can also be set to hidden by
 	// adding their repository in Decks `hidden_repo` setting.
 	Hidden bool `json:"hidden,omitempty"`
+	// Template is the name of a template defined in the same in-repo config file
+	// that this job is based on. All fields that are not set on the job are taken
+	// from the template. Only supported for jobs in in-repo config.
+	Template string `json:"template,omitempty"`
 
 	UtilityConfig
 }
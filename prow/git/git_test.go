@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -105,6 +106,58 @@ func testClone(clients localgit.Clients, t *testing.T) {
 	}
 }
 
+func TestClientForConcurrently(t *testing.T) {
+	testClientForConcurrently(localgit.New, t)
+}
+
+func TestClientForConcurrentlyV2(t *testing.T) {
+	testClientForConcurrently(localgit.NewV2, t)
+}
+
+func testClientForConcurrently(clients localgit.Clients, t *testing.T) {
+	lg, c, err := clients()
+	if err != nil {
+		t.Fatalf("Making local git repo: %v", err)
+	}
+	defer func() {
+		if err := lg.Clean(); err != nil {
+			t.Errorf("Error cleaning LocalGit: %v", err)
+		}
+		if err := c.Clean(); err != nil {
+			t.Errorf("Error cleaning Client: %v", err)
+		}
+	}()
+	repos := []string{"bar", "baz", "qux", "quux"}
+	for _, repo := range repos {
+		if err := lg.MakeFakeRepo("foo", repo); err != nil {
+			t.Fatalf("Making fake repo: %v", err)
+		}
+	}
+
+	// Every repo is cloned twice at the same time, so that clones of the same
+	// and of different repos overlap. Run with -race to detect unsafe access.
+	var wg sync.WaitGroup
+	errs := make([]error, 2*len(repos))
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := c.ClientFor("foo", repos[i%len(repos)])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = r.Clean()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Cloning foo/%s: %v", repos[i%len(repos)], err)
+		}
+	}
+}
+
 func TestCheckoutPR(t *testing.T) {
 	testCheckoutPR(localgit.New, t)
 }
@@ -101,3 +101,15 @@ func (a *repoClientAdapter) RemoteUpdate() error {
 func (a *repoClientAdapter) FetchRef(refspec string) error {
 	return errors.New("no FetchRef implementation exists in the v1 repo client")
 }
+
+func (a *repoClientAdapter) ShowFile(commitlike, path string) ([]byte, error) {
+	return nil, errors.New("no ShowFile implementation exists in the v1 repo client")
+}
+
+func (a *repoClientAdapter) BranchesContaining(commitlike string) ([]string, error) {
+	return nil, errors.New("no BranchesContaining implementation exists in the v1 repo client")
+}
+
+func (a *repoClientAdapter) Apply(path string) error {
+	return errors.New("no Apply implementation exists in the v1 repo client")
+}
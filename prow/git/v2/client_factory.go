@@ -17,6 +17,8 @@ limitations under the License.
 package git
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -39,6 +41,17 @@ type ClientFactory interface {
 	Clean() error
 }
 
+// ShallowClientFactory is a ClientFactory that can also create clients for
+// clones that only have part of the history of a repo.
+type ShallowClientFactory interface {
+	ClientFactory
+	// ShallowClientFor creates a client that operates on a new clone of the repo
+	// that only has the last depth commits of the history of the base and head
+	// SHAs, fetched directly from the remote. The history is deepened until every
+	// head SHA has a merge base with the base SHA.
+	ShallowClientFor(org, repo string, depth int, baseSHA string, headSHAs ...string) (RepoClient, error)
+}
+
 // RepoClient exposes interactions with a git repo
 type RepoClient interface {
 	Publisher
@@ -187,12 +200,12 @@ type clientFactory struct {
 	repoLocks map[string]*sync.Mutex
 }
 
-// bootstrapClients returns a repository client and cloner for a dir.
-func (c *clientFactory) bootstrapClients(org, repo, dir string) (cacher, cloner, RepoClient, error) {
+// bootstrapClients returns a repository client, cloner and shallow fetcher for a dir.
+func (c *clientFactory) bootstrapClients(org, repo, dir string) (cacher, cloner, shallowFetcher, RepoClient, error) {
 	if dir == "" {
 		workdir, err := os.Getwd()
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 		dir = workdir
 	}
@@ -200,7 +213,7 @@ func (c *clientFactory) bootstrapClients(org, repo, dir string) (cacher, cloner,
 	logger.WithField("dir", dir).Debug("Creating a pre-initialized client.")
 	executor, err := NewCensoringExecutor(dir, c.censor, logger)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 	client := &repoClient{
 		publisher: publisher{
@@ -219,13 +232,13 @@ func (c *clientFactory) bootstrapClients(org, repo, dir string) (cacher, cloner,
 			logger:   logger,
 		},
 	}
-	return client, client, client, nil
+	return client, client, client, client, nil
 }
 
 // ClientFromDir returns a repository client for a directory that's already initialized with content.
 // If the directory isn't specified, the current working directory is used.
 func (c *clientFactory) ClientFromDir(org, repo, dir string) (RepoClient, error) {
-	_, _, client, err := c.bootstrapClients(org, repo, dir)
+	_, _, _, client, err := c.bootstrapClients(org, repo, dir)
 	return client, err
 }
 
@@ -237,7 +250,7 @@ func (c *clientFactory) ClientFromDir(org, repo, dir string) (RepoClient, error)
 func (c *clientFactory) ClientFor(org, repo string) (RepoClient, error) {
 	cacheDir := path.Join(c.cacheDir, org, repo)
 	c.logger.WithFields(logrus.Fields{"org": org, "repo": repo, "dir": cacheDir}).Debug("Creating a client from the cache.")
-	cacheClientCacher, _, _, err := c.bootstrapClients(org, repo, cacheDir)
+	cacheClientCacher, _, _, _, err := c.bootstrapClients(org, repo, cacheDir)
 	if err != nil {
 		return nil, err
 	}
@@ -246,17 +259,13 @@ func (c *clientFactory) ClientFor(org, repo string) (RepoClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, repoClientCloner, repoClient, err := c.bootstrapClients(org, repo, repoDir)
+	_, repoClientCloner, _, repoClient, err := c.bootstrapClients(org, repo, repoDir)
 	if err != nil {
 		return nil, err
 	}
-	c.masterLock.Lock()
-	if _, exists := c.repoLocks[cacheDir]; !exists {
-		c.repoLocks[cacheDir] = &sync.Mutex{}
-	}
-	c.masterLock.Unlock()
-	c.repoLocks[cacheDir].Lock()
-	defer c.repoLocks[cacheDir].Unlock()
+	repoLock := c.repoLock(cacheDir)
+	repoLock.Lock()
+	defer repoLock.Unlock()
 	if _, err := os.Stat(path.Join(cacheDir, "HEAD")); os.IsNotExist(err) {
 		// we have not yet cloned this repo, we need to do a full clone
 		if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil && !os.IsExist(err) {
@@ -283,6 +292,72 @@ func (c *clientFactory) ClientFor(org, repo string) (RepoClient, error) {
 	return repoClient, nil
 }
 
+// repoLock returns the lock that guards the cached clone in cacheDir. It is
+// created if it doesn't exist yet.
+func (c *clientFactory) repoLock(cacheDir string) *sync.Mutex {
+	c.masterLock.Lock()
+	defer c.masterLock.Unlock()
+	if _, exists := c.repoLocks[cacheDir]; !exists {
+		c.repoLocks[cacheDir] = &sync.Mutex{}
+	}
+	return c.repoLocks[cacheDir]
+}
+
+// maxDeepens is the number of times the history of a shallow clone is deepened
+// before its complete history is fetched.
+const maxDeepens = 3
+
+// ShallowClientFor returns a repository client for a clone of the specified
+// repository that only has the last depth commits of the history of the base
+// and head SHAs. It doesn't use the cache, so it is faster and needs less disk
+// than ClientFor for large repos. If a head SHA has no merge base with the base
+// SHA in the fetched history, the history is deepened by twice as many commits
+// as before up to maxDeepens times. After that, the complete history is fetched.
+func (c *clientFactory) ShallowClientFor(org, repo string, depth int, baseSHA string, headSHAs ...string) (RepoClient, error) {
+	if depth <= 0 {
+		return nil, fmt.Errorf("depth must be positive, got %d", depth)
+	}
+	if baseSHA == "" {
+		return nil, errors.New("baseSHA must be set")
+	}
+	repoDir, err := ioutil.TempDir(c.cacheDirBase, "gitrepo")
+	if err != nil {
+		return nil, err
+	}
+	_, _, repoFetcher, repoClient, err := c.bootstrapClients(org, repo, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.shallowFetch(repoFetcher, depth, baseSHA, headSHAs...); err != nil {
+		if cleanErr := repoClient.Clean(); cleanErr != nil {
+			c.logger.WithError(cleanErr).WithField("dir", repoDir).Error("Failed to clean up shallow clone.")
+		}
+		return nil, err
+	}
+	return repoClient, nil
+}
+
+func (c *clientFactory) shallowFetch(fetcher shallowFetcher, depth int, baseSHA string, headSHAs ...string) error {
+	commits := append([]string{baseSHA}, headSHAs...)
+	if err := fetcher.ShallowFetch(depth, commits...); err != nil {
+		return err
+	}
+	deepens := 0
+	for _, headSHA := range headSHAs {
+		for !fetcher.MergeBaseExists(baseSHA, headSHA) {
+			if deepens == maxDeepens {
+				return fetcher.Unshallow(commits...)
+			}
+			depth *= 2
+			if err := fetcher.Deepen(depth, commits...); err != nil {
+				return err
+			}
+			deepens++
+		}
+	}
+	return nil
+}
+
 // Clean removes the caches used to generate clients
 func (c *clientFactory) Clean() error {
 	return os.RemoveAll(c.cacheDir)
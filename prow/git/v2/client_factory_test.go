@@ -0,0 +1,93 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/util/diff"
+)
+
+type fakeShallowFetcher struct {
+	// mergeBaseAfter is the number of fetches after which a merge base exists
+	mergeBaseAfter int
+	fetches        int
+	records        []string
+}
+
+func (f *fakeShallowFetcher) ShallowFetch(depth int, commits ...string) error {
+	f.fetches++
+	f.records = append(f.records, fmt.Sprintf("depth=%d %v", depth, commits))
+	return nil
+}
+
+func (f *fakeShallowFetcher) Deepen(depth int, commits ...string) error {
+	f.fetches++
+	f.records = append(f.records, fmt.Sprintf("deepen=%d %v", depth, commits))
+	return nil
+}
+
+func (f *fakeShallowFetcher) Unshallow(commits ...string) error {
+	f.fetches++
+	f.records = append(f.records, fmt.Sprintf("unshallow %v", commits))
+	return nil
+}
+
+func (f *fakeShallowFetcher) MergeBaseExists(commitlike, other string) bool {
+	return f.fetches >= f.mergeBaseAfter
+}
+
+func TestClientFactory_ShallowFetch(t *testing.T) {
+	var testCases = []struct {
+		name            string
+		mergeBaseAfter  int
+		expectedRecords []string
+	}{
+		{
+			name:            "merge base is in the shallow history",
+			mergeBaseAfter:  1,
+			expectedRecords: []string{"depth=10 [base head]"},
+		},
+		{
+			name:            "history is deepened until the merge base is in it",
+			mergeBaseAfter:  3,
+			expectedRecords: []string{"depth=10 [base head]", "deepen=20 [base head]", "deepen=40 [base head]"},
+		},
+		{
+			name:            "complete history is fetched after the maximum number of deepens",
+			mergeBaseAfter:  10,
+			expectedRecords: []string{"depth=10 [base head]", "deepen=20 [base head]", "deepen=40 [base head]", "deepen=80 [base head]", "unshallow [base head]"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			c := &clientFactory{logger: logrus.WithField("test", testCase.name)}
+			f := &fakeShallowFetcher{mergeBaseAfter: testCase.mergeBaseAfter}
+			if err := c.shallowFetch(f, 10, "base", "head"); err != nil {
+				t.Fatalf("%s: expected no error but got one: %v", testCase.name, err)
+			}
+			if actual, expected := f.records, testCase.expectedRecords; !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s: got incorrect fetches: %v", testCase.name, diff.ObjectReflectDiff(actual, expected))
+			}
+		})
+	}
+}
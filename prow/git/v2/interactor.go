@@ -22,7 +22,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -50,6 +52,8 @@ type Interactor interface {
 	MergeAndCheckout(baseSHA string, mergeStrategy string, headSHAs ...string) error
 	// Am calls `git am`
 	Am(path string) error
+	// Apply calls `git apply`
+	Apply(path string) error
 	// Fetch calls `git fetch`
 	Fetch() error
 	// FetchRef fetches the refspec
@@ -66,6 +70,21 @@ type Interactor interface {
 	MergeCommitsExistBetween(target, head string) (bool, error)
 	// ShowRef returns the commit for a commitlike. Unlike rev-parse it does not require a checkout.
 	ShowRef(commitlike string) (string, error)
+	// ShowFile returns the content of the file at path in the commitlike. It does not require a checkout.
+	ShowFile(commitlike, path string) ([]byte, error)
+	// BranchesContaining returns the names of the branches of the remote whose history contains the commitlike.
+	BranchesContaining(commitlike string) ([]string, error)
+}
+
+// ObjectReader is implemented by repo clients that can read the files of a
+// commitlike from the git objects without checking them out. The clients of
+// a ClientFactory implement it, those of the v1 repo client adapter don't.
+type ObjectReader interface {
+	// ShowFile returns the content of the file at path in the commitlike.
+	ShowFile(commitlike, path string) ([]byte, error)
+	// StatFile returns information about the file at path in the commitlike,
+	// without following symlinks.
+	StatFile(commitlike, path string) (os.FileInfo, error)
 }
 
 // cacher knows how to cache and update repositories in a central cache
@@ -82,6 +101,18 @@ type cloner interface {
 	Clone(from string) error
 }
 
+// shallowFetcher knows how to fetch part of the history of commits from the remote
+type shallowFetcher interface {
+	// ShallowFetch initializes the repository and fetches the last depth commits of the history of the commits.
+	ShallowFetch(depth int, commits ...string) error
+	// Deepen fetches depth more commits of the history of the commits.
+	Deepen(depth int, commits ...string) error
+	// Unshallow fetches the complete history of the commits.
+	Unshallow(commits ...string) error
+	// MergeBaseExists determines if two commits have a merge base in the fetched history.
+	MergeBaseExists(commitlike, other string) bool
+}
+
 // MergeOpt holds options for git merge operations.
 // Currently only commit message option is supported.
 type MergeOpt struct {
@@ -128,6 +159,45 @@ func (i *interactor) MirrorClone() error {
 	return nil
 }
 
+// ShallowFetch initializes the repository and fetches the last depth commits
+// of the history of the commits from the remote.
+func (i *interactor) ShallowFetch(depth int, commits ...string) error {
+	i.logger.Infof("Creating a shallow clone of the repo at %s", i.dir)
+	if out, err := i.executor.Run("init"); err != nil {
+		return fmt.Errorf("error initializing the repo: %v %v", err, string(out))
+	}
+	return i.fetchCommits(fmt.Sprintf("--depth=%d", depth), commits...)
+}
+
+// Deepen fetches depth more commits of the history of the commits from the remote.
+func (i *interactor) Deepen(depth int, commits ...string) error {
+	return i.fetchCommits(fmt.Sprintf("--deepen=%d", depth), commits...)
+}
+
+// Unshallow fetches the complete history of the commits from the remote.
+func (i *interactor) Unshallow(commits ...string) error {
+	return i.fetchCommits("--unshallow", commits...)
+}
+
+func (i *interactor) fetchCommits(arg string, commits ...string) error {
+	remote, err := i.remote()
+	if err != nil {
+		return fmt.Errorf("could not resolve remote for fetching: %v", err)
+	}
+	i.logger.Infof("Fetching %v with %s from %s", commits, arg, remote)
+	if out, err := i.executor.Run(append([]string{"fetch", arg, remote}, commits...)...); err != nil {
+		return fmt.Errorf("error fetching %v with %s: %v %v", commits, arg, err, string(out))
+	}
+	return nil
+}
+
+// MergeBaseExists runs 'git merge-base' to determine if the commits have a
+// merge base in the fetched history.
+func (i *interactor) MergeBaseExists(commitlike, other string) bool {
+	_, err := i.executor.Run("merge-base", commitlike, other)
+	return err == nil
+}
+
 // Checkout runs git checkout.
 func (i *interactor) Checkout(commitlike string) error {
 	i.logger.Infof("Checking out %q", commitlike)
@@ -173,6 +243,13 @@ func (i *interactor) Merge(commitlike string) (bool, error) {
 // It returns true if the merge completes. if the merge does not complete successfully, we try to
 // abort it and return an error if the abort fails.
 func (i *interactor) MergeWithStrategy(commitlike, mergeStrategy string, opts ...MergeOpt) (bool, error) {
+	ok, _, err := i.mergeWithStrategy(commitlike, mergeStrategy, opts...)
+	return ok, err
+}
+
+// mergeWithStrategy is like MergeWithStrategy, but additionally returns the
+// files that had conflicts if the merge did not complete.
+func (i *interactor) mergeWithStrategy(commitlike, mergeStrategy string, opts ...MergeOpt) (bool, []string, error) {
 	i.logger.Infof("Merging %q using the %q strategy", commitlike, mergeStrategy)
 	switch mergeStrategy {
 	case "merge":
@@ -180,11 +257,11 @@ func (i *interactor) MergeWithStrategy(commitlike, mergeStrategy string, opts ..
 	case "squash":
 		return i.squashMerge(commitlike)
 	default:
-		return false, fmt.Errorf("merge strategy %q is not supported", mergeStrategy)
+		return false, nil, fmt.Errorf("merge strategy %q is not supported", mergeStrategy)
 	}
 }
 
-func (i *interactor) mergeMerge(commitlike string, opts ...MergeOpt) (bool, error) {
+func (i *interactor) mergeMerge(commitlike string, opts ...MergeOpt) (bool, []string, error) {
 	args := []string{"merge", "--no-ff", "--no-stat"}
 
 	if len(opts) == 0 {
@@ -199,36 +276,74 @@ func (i *interactor) mergeMerge(commitlike string, opts ...MergeOpt) (bool, erro
 
 	out, err := i.executor.Run(args...)
 	if err == nil {
-		return true, nil
+		return true, nil, nil
 	}
 	i.logger.WithError(err).Warnf("Error merging %q: %s", commitlike, string(out))
+	conflicts := i.conflictingFiles()
 	if out, err := i.executor.Run("merge", "--abort"); err != nil {
-		return false, fmt.Errorf("error aborting merge of %q: %v %v", commitlike, err, string(out))
+		return false, conflicts, fmt.Errorf("error aborting merge of %q: %v %v", commitlike, err, string(out))
 	}
-	return false, nil
+	return false, conflicts, nil
 }
 
-func (i *interactor) squashMerge(commitlike string) (bool, error) {
+func (i *interactor) squashMerge(commitlike string) (bool, []string, error) {
 	out, err := i.executor.Run("merge", "--squash", "--no-stat", commitlike)
 	if err != nil {
 		i.logger.WithError(err).Warnf("Error staging merge for %q: %s", commitlike, string(out))
+		conflicts := i.conflictingFiles()
 		if out, err := i.executor.Run("reset", "--hard", "HEAD"); err != nil {
-			return false, fmt.Errorf("error aborting merge of %q: %v %v", commitlike, err, string(out))
+			return false, conflicts, fmt.Errorf("error aborting merge of %q: %v %v", commitlike, err, string(out))
 		}
-		return false, nil
+		return false, conflicts, nil
 	}
 	out, err = i.executor.Run("commit", "--no-stat", "-m", "merge")
 	if err != nil {
 		i.logger.WithError(err).Warnf("Error committing merge for %q: %s", commitlike, string(out))
 		if out, err := i.executor.Run("reset", "--hard", "HEAD"); err != nil {
-			return false, fmt.Errorf("error aborting merge of %q: %v %v", commitlike, err, string(out))
+			return false, nil, fmt.Errorf("error aborting merge of %q: %v %v", commitlike, err, string(out))
 		}
-		return false, nil
+		return false, nil, nil
+	}
+	return true, nil, nil
+}
+
+// conflictingFiles lists the files with unresolved conflicts of a merge that
+// failed and was not aborted yet. As the result is only informational, errors
+// are logged rather than returned.
+func (i *interactor) conflictingFiles() []string {
+	out, err := i.executor.Run("diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		i.logger.WithError(err).Warnf("Error listing conflicting files: %s", string(out))
+		return nil
+	}
+	var files []string
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	scan.Split(bufio.ScanLines)
+	for scan.Scan() {
+		files = append(files, scan.Text())
+	}
+	return files
+}
+
+// MergeError is returned by MergeAndCheckout if a commitlike could not be
+// merged.
+type MergeError struct {
+	// Commitlike is the commitlike that could not be merged.
+	Commitlike string
+	// ConflictingFiles are the files that had conflicts. It is empty if
+	// they could not be determined.
+	ConflictingFiles []string
+}
+
+func (e *MergeError) Error() string {
+	if len(e.ConflictingFiles) == 0 {
+		return fmt.Sprintf("failed to merge %q", e.Commitlike)
 	}
-	return true, nil
+	return fmt.Sprintf("failed to merge %q, conflicting files: %s", e.Commitlike, strings.Join(e.ConflictingFiles, ", "))
 }
 
-// Only the `merge` and `squash` strategies are supported.
+// Only the `merge` and `squash` strategies are supported. If a commitlike
+// can not be merged, a *MergeError is returned.
 func (i *interactor) MergeAndCheckout(baseSHA string, mergeStrategy string, headSHAs ...string) error {
 	if baseSHA == "" {
 		return errors.New("baseSHA must be set")
@@ -237,11 +352,11 @@ func (i *interactor) MergeAndCheckout(baseSHA string, mergeStrategy string, head
 		return err
 	}
 	for _, headSHA := range headSHAs {
-		ok, err := i.MergeWithStrategy(headSHA, mergeStrategy)
+		ok, conflicts, err := i.mergeWithStrategy(headSHA, mergeStrategy)
 		if err != nil {
 			return err
 		} else if !ok {
-			return fmt.Errorf("failed to merge %q", headSHA)
+			return &MergeError{Commitlike: headSHA, ConflictingFiles: conflicts}
 		}
 	}
 	return nil
@@ -263,6 +378,18 @@ func (i *interactor) Am(path string) error {
 	return errors.New(string(bytes.TrimPrefix(out, []byte("The copy of the patch that failed is found in: .git/rebase-apply/patch"))))
 }
 
+// Apply applies the patch in the given path to the working tree without
+// creating a commit. Unlike Am, it also accepts plain unified diffs. It
+// returns an error if the patch cannot be applied, in which case the working
+// tree is left unchanged.
+func (i *interactor) Apply(path string) error {
+	i.logger.Infof("Applying patch at %s to the working tree", path)
+	if out, err := i.executor.Run("apply", path); err != nil {
+		return fmt.Errorf("error applying patch: %v %v", err, string(out))
+	}
+	return nil
+}
+
 // RemoteUpdate fetches all updates from the remote.
 func (i *interactor) RemoteUpdate() error {
 	i.logger.Info("Updating from remote")
@@ -373,3 +500,94 @@ func (i *interactor) ShowRef(commitlike string) (string, error) {
 	}
 	return strings.TrimSpace(string(out)), nil
 }
+
+// BranchesContaining runs 'git for-each-ref --contains' to list the
+// remote-tracking branches of origin that contain the commitlike.
+func (i *interactor) BranchesContaining(commitlike string) ([]string, error) {
+	i.logger.Infof("Listing the branches that contain %s", commitlike)
+	const prefix = "refs/remotes/origin/"
+	out, err := i.executor.Run("for-each-ref", "--format=%(refname)", "--contains", commitlike, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the branches that contain %s: %v %s", commitlike, err, string(out))
+	}
+	var branches []string
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		// The symbolic ref to the default branch of origin is no branch.
+		if branch := strings.TrimPrefix(scan.Text(), prefix); branch != "HEAD" {
+			branches = append(branches, branch)
+		}
+	}
+	return branches, nil
+}
+
+// StatFile runs 'git ls-tree' to get information about the file at path in
+// the commitlike. If the file doesn't exist there, the error satisfies
+// os.IsNotExist.
+func (i *interactor) StatFile(commitlike, path string) (os.FileInfo, error) {
+	i.logger.Infof("Getting information about %s in %s", path, commitlike)
+	out, err := i.executor.Run("ls-tree", "-l", commitlike, "--", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s in %s: %v %s", path, commitlike, err, string(out))
+	}
+	// The output is "<mode> <type> <object> <size>\t<path>", or empty if the
+	// path doesn't exist.
+	line := strings.TrimSuffix(string(out), "\n")
+	if line == "" {
+		return nil, &os.PathError{Op: "ls-tree", Path: path, Err: os.ErrNotExist}
+	}
+	parts := strings.SplitN(line, "\t", 2)
+	fields := strings.Fields(parts[0])
+	if len(parts) != 2 || len(fields) != 4 || parts[1] != path {
+		return nil, fmt.Errorf("unexpected output listing %s in %s: %s", path, commitlike, line)
+	}
+	info := treeEntryInfo{name: path[strings.LastIndex(path, "/")+1:]}
+	switch fields[0] {
+	case "100644":
+		info.mode = 0644
+	case "100755":
+		info.mode = 0755
+	case "120000":
+		info.mode = os.ModeSymlink | 0777
+	case "040000":
+		info.mode = os.ModeDir | 0755
+	default:
+		// Submodules and other entries are no files that can be read.
+		info.mode = os.ModeIrregular
+	}
+	if fields[3] != "-" {
+		if info.size, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse size of %s in %s: %v", path, commitlike, err)
+		}
+	}
+	return info, nil
+}
+
+// treeEntryInfo is the os.FileInfo of an entry of a git tree.
+type treeEntryInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (i treeEntryInfo) Name() string       { return i.name }
+func (i treeEntryInfo) Size() int64        { return i.size }
+func (i treeEntryInfo) Mode() os.FileMode  { return i.mode }
+func (i treeEntryInfo) ModTime() time.Time { return time.Time{} }
+func (i treeEntryInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i treeEntryInfo) Sys() interface{}   { return nil }
+
+// ShowFile runs 'git show <commitlike>:<path>' to get the content of the file
+// at path in the commitlike. If the file doesn't exist there, the error
+// satisfies os.IsNotExist.
+func (i *interactor) ShowFile(commitlike, path string) ([]byte, error) {
+	i.logger.Infof("Getting the content of %s in %s", path, commitlike)
+	out, err := i.executor.Run("show", fmt.Sprintf("%s:%s", commitlike, path))
+	if err != nil {
+		if bytes.Contains(out, []byte("does not exist in")) || bytes.Contains(out, []byte("exists on disk, but not in")) {
+			return nil, &os.PathError{Op: "show", Path: path, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("failed to get content of %s in %s: %v %s", path, commitlike, err, string(out))
+	}
+	return out, nil
+}
@@ -19,6 +19,7 @@ package git
 import (
 	"errors"
 	"fmt"
+	"os"
 	"reflect"
 	"testing"
 
@@ -459,6 +460,7 @@ func TestInteractor_Merge(t *testing.T) {
 			},
 			expectedCalls: [][]string{
 				{"merge", "--no-ff", "--no-stat", "-m", "merge", "shasum"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"merge", "--abort"},
 			},
 			expectedMerge: false,
@@ -477,6 +479,7 @@ func TestInteractor_Merge(t *testing.T) {
 			},
 			expectedCalls: [][]string{
 				{"merge", "--no-ff", "--no-stat", "-m", "merge", "shasum"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"merge", "--abort"},
 			},
 			expectedMerge: false,
@@ -633,6 +636,7 @@ func TestInteractor_MergeWithStrategy(t *testing.T) {
 			},
 			expectedCalls: [][]string{
 				{"merge", "--no-ff", "--no-stat", "-m", "merge", "shasum"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"merge", "--abort"},
 			},
 			expectedMerge: false,
@@ -652,6 +656,7 @@ func TestInteractor_MergeWithStrategy(t *testing.T) {
 			},
 			expectedCalls: [][]string{
 				{"merge", "--no-ff", "--no-stat", "-m", "merge", "shasum"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"merge", "--abort"},
 			},
 			expectedMerge: false,
@@ -671,6 +676,7 @@ func TestInteractor_MergeWithStrategy(t *testing.T) {
 			},
 			expectedCalls: [][]string{
 				{"merge", "--squash", "--no-stat", "shasum"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"reset", "--hard", "HEAD"},
 			},
 			expectedMerge: false,
@@ -690,6 +696,7 @@ func TestInteractor_MergeWithStrategy(t *testing.T) {
 			},
 			expectedCalls: [][]string{
 				{"merge", "--squash", "--no-stat", "shasum"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"reset", "--hard", "HEAD"},
 			},
 			expectedMerge: false,
@@ -890,6 +897,7 @@ func TestInteractor_MergeAndCheckout(t *testing.T) {
 			expectedCalls: [][]string{
 				{"checkout", "base"},
 				{"merge", "--no-ff", "--no-stat", "-m", "merge", "first"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"merge", "--abort"},
 			},
 			expectedErr: true,
@@ -913,6 +921,7 @@ func TestInteractor_MergeAndCheckout(t *testing.T) {
 			expectedCalls: [][]string{
 				{"checkout", "base"},
 				{"merge", "--no-ff", "--no-stat", "-m", "merge", "first"},
+				{"diff", "--name-only", "--diff-filter=U"},
 				{"merge", "--abort"},
 			},
 			expectedErr: true,
@@ -944,6 +953,42 @@ func TestInteractor_MergeAndCheckout(t *testing.T) {
 	}
 }
 
+func TestInteractor_MergeAndCheckoutConflicts(t *testing.T) {
+	e := fakeExecutor{
+		records: [][]string{},
+		responses: map[string]execResponse{
+			"checkout base": {
+				out: []byte(`ok`),
+			},
+			"merge --no-ff --no-stat -m merge first": {
+				err: errors.New("oops"),
+			},
+			"diff --name-only --diff-filter=U": {
+				out: []byte("main.go\nREADME.md\n"),
+			},
+			"merge --abort": {
+				out: []byte(`ok`),
+			},
+		},
+	}
+	i := interactor{
+		executor: &e,
+		logger:   logrus.WithField("test", "conflicts"),
+	}
+	err := i.MergeAndCheckout("base", "merge", "first")
+	mergeErr, ok := err.(*MergeError)
+	if !ok {
+		t.Fatalf("expected a *MergeError, got %T: %v", err, err)
+	}
+	expected := &MergeError{Commitlike: "first", ConflictingFiles: []string{"main.go", "README.md"}}
+	if !reflect.DeepEqual(mergeErr, expected) {
+		t.Errorf("got incorrect error: %v", diff.ObjectReflectDiff(mergeErr, expected))
+	}
+	if expectedMsg := `failed to merge "first", conflicting files: main.go, README.md`; err.Error() != expectedMsg {
+		t.Errorf("expected error message %q, got %q", expectedMsg, err.Error())
+	}
+}
+
 func TestInteractor_Am(t *testing.T) {
 	var testCases = []struct {
 		name          string
@@ -1027,6 +1072,65 @@ func TestInteractor_Am(t *testing.T) {
 	}
 }
 
+func TestInteractor_Apply(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		path          string
+		responses     map[string]execResponse
+		expectedCalls [][]string
+		expectedErr   bool
+	}{
+		{
+			name: "happy case",
+			path: "my/changes.diff",
+			responses: map[string]execResponse{
+				"apply my/changes.diff": {},
+			},
+			expectedCalls: [][]string{
+				{"apply", "my/changes.diff"},
+			},
+			expectedErr: false,
+		},
+		{
+			name: "apply fails",
+			path: "my/changes.diff",
+			responses: map[string]execResponse{
+				"apply my/changes.diff": {
+					out: []byte("error: patch failed: .prow.yaml:1"),
+					err: errors.New("oops"),
+				},
+			},
+			expectedCalls: [][]string{
+				{"apply", "my/changes.diff"},
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := fakeExecutor{
+				records:   [][]string{},
+				responses: testCase.responses,
+			}
+			i := interactor{
+				executor: &e,
+				logger:   logrus.WithField("test", testCase.name),
+			}
+			actualErr := i.Apply(testCase.path)
+			if testCase.expectedErr && actualErr == nil {
+				t.Errorf("%s: expected an error but got none", testCase.name)
+			}
+			if !testCase.expectedErr && actualErr != nil {
+				t.Errorf("%s: expected no error but got one: %v", testCase.name, actualErr)
+			}
+			if actual, expected := e.records, testCase.expectedCalls; !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s: got incorrect git calls: %v", testCase.name, diff.ObjectReflectDiff(actual, expected))
+			}
+		})
+	}
+}
+
 func TestInteractor_RemoteUpdate(t *testing.T) {
 	var testCases = []struct {
 		name          string
@@ -1741,3 +1845,316 @@ func TestInteractor_ShowRef(t *testing.T) {
 		})
 	}
 }
+
+func TestInteractor_ShallowFetch(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		remote        RemoteResolver
+		responses     map[string]execResponse
+		expectedCalls [][]string
+		expectedErr   bool
+	}{
+		{
+			name: "happy case",
+			remote: func() (string, error) {
+				return "someone.com", nil
+			},
+			responses: map[string]execResponse{
+				"init": {
+					out: []byte(`ok`),
+				},
+				"fetch --depth=10 someone.com base head": {
+					out: []byte(`ok`),
+				},
+			},
+			expectedCalls: [][]string{
+				{"init"},
+				{"fetch", "--depth=10", "someone.com", "base", "head"},
+			},
+			expectedErr: false,
+		},
+		{
+			name: "init fails",
+			remote: func() (string, error) {
+				return "someone.com", nil
+			},
+			responses: map[string]execResponse{
+				"init": {
+					err: errors.New("oops"),
+				},
+			},
+			expectedCalls: [][]string{
+				{"init"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "remote resolution fails",
+			remote: func() (string, error) {
+				return "", errors.New("oops")
+			},
+			responses: map[string]execResponse{
+				"init": {
+					out: []byte(`ok`),
+				},
+			},
+			expectedCalls: [][]string{
+				{"init"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "fetch fails",
+			remote: func() (string, error) {
+				return "someone.com", nil
+			},
+			responses: map[string]execResponse{
+				"init": {
+					out: []byte(`ok`),
+				},
+				"fetch --depth=10 someone.com base head": {
+					err: errors.New("oops"),
+				},
+			},
+			expectedCalls: [][]string{
+				{"init"},
+				{"fetch", "--depth=10", "someone.com", "base", "head"},
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := fakeExecutor{
+				records:   [][]string{},
+				responses: testCase.responses,
+			}
+			i := interactor{
+				executor: &e,
+				remote:   testCase.remote,
+				logger:   logrus.WithField("test", testCase.name),
+			}
+			actualErr := i.ShallowFetch(10, "base", "head")
+			if testCase.expectedErr && actualErr == nil {
+				t.Errorf("%s: expected an error but got none", testCase.name)
+			}
+			if !testCase.expectedErr && actualErr != nil {
+				t.Errorf("%s: expected no error but got one: %v", testCase.name, actualErr)
+			}
+			if actual, expected := e.records, testCase.expectedCalls; !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s: got incorrect git calls: %v", testCase.name, diff.ObjectReflectDiff(actual, expected))
+			}
+		})
+	}
+}
+
+func TestInteractor_ShowFile(t *testing.T) {
+	var testCases = []struct {
+		name             string
+		responses        map[string]execResponse
+		expectedContent  string
+		expectedErr      bool
+		expectedNotExist bool
+	}{
+		{
+			name: "happy case",
+			responses: map[string]execResponse{
+				"show sha:dir/file": {out: []byte("content\n")},
+			},
+			expectedContent: "content\n",
+		},
+		{
+			name: "file doesn't exist",
+			responses: map[string]execResponse{
+				"show sha:dir/file": {out: []byte("fatal: path 'dir/file' does not exist in 'sha'"), err: errors.New("exit status 128")},
+			},
+			expectedErr:      true,
+			expectedNotExist: true,
+		},
+		{
+			name: "commit doesn't exist",
+			responses: map[string]execResponse{
+				"show sha:dir/file": {out: []byte("fatal: invalid object name 'sha'."), err: errors.New("exit status 128")},
+			},
+			expectedErr: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := fakeExecutor{
+				records:   [][]string{},
+				responses: testCase.responses,
+			}
+			i := interactor{
+				executor: &e,
+				logger:   logrus.WithField("test", testCase.name),
+			}
+			actual, actualErr := i.ShowFile("sha", "dir/file")
+			if testCase.expectedErr && actualErr == nil {
+				t.Errorf("%s: expected an error but got none", testCase.name)
+			}
+			if !testCase.expectedErr && actualErr != nil {
+				t.Errorf("%s: expected no error but got one: %v", testCase.name, actualErr)
+			}
+			if notExist := os.IsNotExist(actualErr); notExist != testCase.expectedNotExist {
+				t.Errorf("%s: expected os.IsNotExist to be %t, was %t", testCase.name, testCase.expectedNotExist, notExist)
+			}
+			if string(actual) != testCase.expectedContent {
+				t.Errorf("%s: expected content %q, got %q", testCase.name, testCase.expectedContent, string(actual))
+			}
+			if expected := [][]string{{"show", "sha:dir/file"}}; !reflect.DeepEqual(e.records, expected) {
+				t.Errorf("%s: got incorrect git calls: %v", testCase.name, diff.ObjectReflectDiff(e.records, expected))
+			}
+		})
+	}
+}
+
+func TestInteractor_StatFile(t *testing.T) {
+	var testCases = []struct {
+		name             string
+		responses        map[string]execResponse
+		expectedMode     os.FileMode
+		expectedSize     int64
+		expectedErr      bool
+		expectedNotExist bool
+	}{
+		{
+			name: "regular file",
+			responses: map[string]execResponse{
+				"ls-tree -l sha -- dir/file": {out: []byte("100644 blob 8baef1b4abc478178b004d62031cf7fe6db6f903      12\tdir/file\n")},
+			},
+			expectedMode: 0644,
+			expectedSize: 12,
+		},
+		{
+			name: "executable file",
+			responses: map[string]execResponse{
+				"ls-tree -l sha -- dir/file": {out: []byte("100755 blob 8baef1b4abc478178b004d62031cf7fe6db6f903       3\tdir/file\n")},
+			},
+			expectedMode: 0755,
+			expectedSize: 3,
+		},
+		{
+			name: "symlink",
+			responses: map[string]execResponse{
+				"ls-tree -l sha -- dir/file": {out: []byte("120000 blob 8baef1b4abc478178b004d62031cf7fe6db6f903       5\tdir/file\n")},
+			},
+			expectedMode: os.ModeSymlink | 0777,
+			expectedSize: 5,
+		},
+		{
+			name: "directory",
+			responses: map[string]execResponse{
+				"ls-tree -l sha -- dir/file": {out: []byte("040000 tree 8baef1b4abc478178b004d62031cf7fe6db6f903       -\tdir/file\n")},
+			},
+			expectedMode: os.ModeDir | 0755,
+		},
+		{
+			name: "file doesn't exist",
+			responses: map[string]execResponse{
+				"ls-tree -l sha -- dir/file": {},
+			},
+			expectedErr:      true,
+			expectedNotExist: true,
+		},
+		{
+			name: "commit doesn't exist",
+			responses: map[string]execResponse{
+				"ls-tree -l sha -- dir/file": {out: []byte("fatal: Not a valid object name sha"), err: errors.New("exit status 128")},
+			},
+			expectedErr: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := fakeExecutor{
+				records:   [][]string{},
+				responses: testCase.responses,
+			}
+			i := interactor{
+				executor: &e,
+				logger:   logrus.WithField("test", testCase.name),
+			}
+			info, actualErr := i.StatFile("sha", "dir/file")
+			if testCase.expectedErr && actualErr == nil {
+				t.Errorf("%s: expected an error but got none", testCase.name)
+			}
+			if !testCase.expectedErr && actualErr != nil {
+				t.Errorf("%s: expected no error but got one: %v", testCase.name, actualErr)
+			}
+			if notExist := os.IsNotExist(actualErr); notExist != testCase.expectedNotExist {
+				t.Errorf("%s: expected os.IsNotExist to be %t, was %t", testCase.name, testCase.expectedNotExist, notExist)
+			}
+			if info != nil {
+				if info.Name() != "file" {
+					t.Errorf("%s: expected name file, got %q", testCase.name, info.Name())
+				}
+				if info.Mode() != testCase.expectedMode {
+					t.Errorf("%s: expected mode %v, got %v", testCase.name, testCase.expectedMode, info.Mode())
+				}
+				if info.Size() != testCase.expectedSize {
+					t.Errorf("%s: expected size %d, got %d", testCase.name, testCase.expectedSize, info.Size())
+				}
+			}
+			if expected := [][]string{{"ls-tree", "-l", "sha", "--", "dir/file"}}; !reflect.DeepEqual(e.records, expected) {
+				t.Errorf("%s: got incorrect git calls: %v", testCase.name, diff.ObjectReflectDiff(e.records, expected))
+			}
+		})
+	}
+}
+
+func TestInteractor_BranchesContaining(t *testing.T) {
+	var testCases = []struct {
+		name             string
+		responses        map[string]execResponse
+		expectedBranches []string
+		expectedErr      bool
+	}{
+		{
+			name: "happy case",
+			responses: map[string]execResponse{
+				"for-each-ref --format=%(refname) --contains sha refs/remotes/origin/": {out: []byte("refs/remotes/origin/HEAD\nrefs/remotes/origin/master\nrefs/remotes/origin/release/1.0\n")},
+			},
+			expectedBranches: []string{"master", "release/1.0"},
+		},
+		{
+			name: "no branch contains the commit",
+			responses: map[string]execResponse{
+				"for-each-ref --format=%(refname) --contains sha refs/remotes/origin/": {},
+			},
+		},
+		{
+			name: "commit doesn't exist",
+			responses: map[string]execResponse{
+				"for-each-ref --format=%(refname) --contains sha refs/remotes/origin/": {out: []byte("error: malformed object name sha"), err: errors.New("exit status 129")},
+			},
+			expectedErr: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			e := fakeExecutor{
+				records:   [][]string{},
+				responses: testCase.responses,
+			}
+			i := interactor{
+				executor: &e,
+				logger:   logrus.WithField("test", testCase.name),
+			}
+			actual, actualErr := i.BranchesContaining("sha")
+			if testCase.expectedErr && actualErr == nil {
+				t.Errorf("%s: expected an error but got none", testCase.name)
+			}
+			if !testCase.expectedErr && actualErr != nil {
+				t.Errorf("%s: expected no error but got one: %v", testCase.name, actualErr)
+			}
+			if !reflect.DeepEqual(actual, testCase.expectedBranches) {
+				t.Errorf("%s: expected branches %v, got %v", testCase.name, testCase.expectedBranches, actual)
+			}
+			if expected := [][]string{{"for-each-ref", "--format=%(refname)", "--contains", "sha", "refs/remotes/origin/"}}; !reflect.DeepEqual(e.records, expected) {
+				t.Errorf("%s: got incorrect git calls: %v", testCase.name, diff.ObjectReflectDiff(e.records, expected))
+			}
+		})
+	}
+}
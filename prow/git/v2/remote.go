@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"strings"
 )
 
 // RemoteResolverFactory knows how to construct remote resolvers for
@@ -47,6 +48,31 @@ type LoginGetter func() (login string, err error)
 // TokenGetter fetches a GitHub OAuth token on-demand
 type TokenGetter func() []byte
 
+// urlRemote returns a resolver for the repo if org is not an org on the host
+// of a RemoteResolverFactory, but the URL of a directory of repos on an
+// arbitrary git host, e.g. "https://git.example.com/team". No credentials are
+// added to its remote, as those for the host must not be sent to other hosts.
+func urlRemote(org, repo string) (RemoteResolver, bool) {
+	if !strings.Contains(org, "://") {
+		return nil, false
+	}
+	remote := fmt.Sprintf("%s/%s", strings.TrimSuffix(org, "/"), repo)
+	return func() (string, error) {
+		return remote, nil
+	}, true
+}
+
+// urlPublishRemote returns a resolver that always fails if org is the URL of
+// a directory of repos on an arbitrary git host, as there are no forks there.
+func urlPublishRemote(org string) (RemoteResolver, bool) {
+	if !strings.Contains(org, "://") {
+		return nil, false
+	}
+	return func() (string, error) {
+		return "", fmt.Errorf("publishing is not supported for repos of %s", org)
+	}, true
+}
+
 type sshRemoteResolverFactory struct {
 	host     string
 	username LoginGetter
@@ -55,6 +81,9 @@ type sshRemoteResolverFactory struct {
 // CentralRemote creates a remote resolver that refers to an authoritative remote
 // for the repository.
 func (f *sshRemoteResolverFactory) CentralRemote(org, repo string) RemoteResolver {
+	if remote, ok := urlRemote(org, repo); ok {
+		return remote
+	}
 	remote := fmt.Sprintf("git@%s:%s/%s.git", f.host, org, repo)
 	return func() (string, error) {
 		return remote, nil
@@ -63,7 +92,10 @@ func (f *sshRemoteResolverFactory) CentralRemote(org, repo string) RemoteResolve
 
 // PublishRemote creates a remote resolver that refers to a user's remote
 // for the repository that can be published to.
-func (f *sshRemoteResolverFactory) PublishRemote(_, repo string) RemoteResolver {
+func (f *sshRemoteResolverFactory) PublishRemote(org, repo string) RemoteResolver {
+	if remote, ok := urlPublishRemote(org); ok {
+		return remote
+	}
 	return func() (string, error) {
 		org, err := f.username()
 		if err != nil {
@@ -83,6 +115,9 @@ type httpResolverFactory struct {
 // CentralRemote creates a remote resolver that refers to an authoritative remote
 // for the repository.
 func (f *httpResolverFactory) CentralRemote(org, repo string) RemoteResolver {
+	if remote, ok := urlRemote(org, repo); ok {
+		return remote
+	}
 	return HttpResolver(func() (*url.URL, error) {
 		return &url.URL{Scheme: "https", Host: f.host, Path: fmt.Sprintf("%s/%s", org, repo)}, nil
 	}, f.username, f.token)
@@ -90,7 +125,10 @@ func (f *httpResolverFactory) CentralRemote(org, repo string) RemoteResolver {
 
 // PublishRemote creates a remote resolver that refers to a user's remote
 // for the repository that can be published to.
-func (f *httpResolverFactory) PublishRemote(_, repo string) RemoteResolver {
+func (f *httpResolverFactory) PublishRemote(org, repo string) RemoteResolver {
+	if remote, ok := urlPublishRemote(org); ok {
+		return remote
+	}
 	return HttpResolver(func() (*url.URL, error) {
 		if f.username == nil {
 			return nil, errors.New("username not configured, no publish repo available")
@@ -132,6 +170,9 @@ type pathResolverFactory struct {
 // CentralRemote creates a remote resolver that refers to an authoritative remote
 // for the repository.
 func (f *pathResolverFactory) CentralRemote(org, repo string) RemoteResolver {
+	if remote, ok := urlRemote(org, repo); ok {
+		return remote
+	}
 	return func() (string, error) {
 		return path.Join(f.baseDir, org, repo), nil
 	}
@@ -140,6 +181,9 @@ func (f *pathResolverFactory) CentralRemote(org, repo string) RemoteResolver {
 // PublishRemote creates a remote resolver that refers to a user's remote
 // for the repository that can be published to.
 func (f *pathResolverFactory) PublishRemote(org, repo string) RemoteResolver {
+	if remote, ok := urlPublishRemote(org); ok {
+		return remote
+	}
 	return func() (string, error) {
 		return path.Join(f.baseDir, org, repo), nil
 	}
@@ -224,3 +224,33 @@ func TestHTTPResolverFactory(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoteResolverFactoriesURLOrg(t *testing.T) {
+	const org = "https://git.internal.example.com/team/sub"
+	factories := map[string]RemoteResolverFactory{
+		"ssh": &sshRemoteResolverFactory{host: "ssh.host.com", username: usernameVendor([]stringWithError{{str: "user"}})},
+		"http": &httpResolverFactory{
+			host:     "host.com",
+			username: usernameVendor([]stringWithError{{str: "user"}}),
+			token:    tokenVendor([][]byte{[]byte("token")}),
+		},
+		"path": &pathResolverFactory{baseDir: "/tmp/repos"},
+	}
+	for name, factory := range factories {
+		t.Run(name, func(t *testing.T) {
+			expected := "https://git.internal.example.com/team/sub/project"
+			actual, err := factory.CentralRemote(org, "project")()
+			if err != nil {
+				t.Fatalf("CentralRemote: %v", err)
+			}
+			if actual != expected {
+				t.Errorf("Expected central remote to be %s without credentials, was %s", expected, actual)
+			}
+
+			expectedErr := "publishing is not supported for repos of https://git.internal.example.com/team/sub"
+			if _, err := factory.PublishRemote(org, "project")(); err == nil || err.Error() != expectedErr {
+				t.Errorf("Expected error to be %s, was %v", expectedErr, err)
+			}
+		})
+	}
+}